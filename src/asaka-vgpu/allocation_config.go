@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// allocationConfigEnv delivers the allocation in env vars.
+	allocationConfigEnv = "env"
+	// allocationConfigFile delivers the allocation in a file mounted
+	// read-only into the container.
+	allocationConfigFile = "file"
+
+	allocationConfigFileName = "allocation.json"
+)
+
+// allocationConfig is the allocation config file of a container.
+type allocationConfig struct {
+	AllocationId  string          `json:"allocation_id"`
+	ControllerUri string          `json:"controller_uri"`
+	VgpuIds       []string        `json:"vgpu_ids"`
+	Dev           string          `json:"dev"`
+	Allocation    json.RawMessage `json:"allocation,omitempty"`
+}
+
+// containerResponse returns what kubelet has to set up for a container holding
+// the allocation of entry.
+func containerResponse(entry *allocationEntry) (*pluginapi.ContainerAllocateResponse, error) {
+	config := currentConfig()
+	if config.AllocationConfigMode != allocationConfigFile {
+		envMap := make(map[string]string, len(entry.Envs))
+		for k, v := range entry.Envs {
+			envMap[k] = v
+		}
+		response := &pluginapi.ContainerAllocateResponse{
+			Envs:        envMap,
+			Annotations: allocationAnnotations(entry),
+		}
+		injectClientRuntime(response, entry.Protocol)
+		return response, nil
+	}
+
+	dir, err := configDir(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeAllocationConfig(dir, entry); err != nil {
+		return nil, err
+	}
+	response := &pluginapi.ContainerAllocateResponse{
+		Envs: map[string]string{
+			"ASAKA_K8S":             "1",
+			"ASAKA_ALLOCATION_FILE": path.Join(config.AllocationConfigMountPath, allocationConfigFileName),
+		},
+		Mounts: []*pluginapi.Mount{
+			{
+				ContainerPath: config.AllocationConfigMountPath,
+				HostPath:      dir,
+				ReadOnly:      true,
+			},
+		},
+		Annotations: allocationAnnotations(entry),
+	}
+	injectClientRuntime(response, entry.Protocol)
+	return response, nil
+}
+
+// allocationAnnotations describes the allocation of entry for runtime hooks and
+// audit tooling.
+func allocationAnnotations(entry *allocationEntry) map[string]string {
+	prefix := currentConfig().AnnotationPrefix
+	protocol := entry.Protocol
+	if protocol == "" {
+		protocol = servedProtocol
+	}
+	return map[string]string{
+		prefix + "allocation-id": entry.AllocationId,
+		prefix + "controller":    entry.ControllerUri,
+		prefix + "device-ids":    strings.Join(entry.DeviceIds, ","),
+		prefix + "server-ips":    strings.Join(entry.ServerIps, ","),
+		prefix + "protocol":      protocol,
+	}
+}
+
+func writeAllocationConfig(dir string, entry *allocationEntry) error {
+	config := allocationConfig{
+		AllocationId:  entry.AllocationId,
+		ControllerUri: entry.ControllerUri,
+		VgpuIds:       entry.VgpuIds,
+		Dev:           entry.Envs["DEV"],
+	}
+	if len(entry.Servers) > 0 {
+		allocation := &AsakaAllocation{AllocationId: entry.AllocationId, Servers: entry.Servers, Raw: entry.AllocationStr}
+		config.Dev = allocation.DevString()
+	}
+	if json.Valid([]byte(entry.AllocationStr)) {
+		config.Allocation = json.RawMessage(entry.AllocationStr)
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, allocationConfigFileName), data)
+}
+
+// allocationDir returns the host directory of an allocation. The allocation ID
+// comes from the XaaS Controller, it must not lead out of the allocation host
+// directory.
+func allocationDir(allocationId string) (string, error) {
+	if err := validAllocationId(allocationId); err != nil {
+		return "", err
+	}
+	hostDir := filepath.Clean(currentConfig().AllocationHostDir)
+	dir := filepath.Join(hostDir, allocationId)
+	if filepath.Dir(dir) != hostDir {
+		return "", fmt.Errorf("Directory of allocation %q is outside of %s", allocationId, hostDir)
+	}
+	return dir, nil
+}
+
+// configDir returns the host directory mounted into the container of entry in
+// file mode. Reserving again keeps the directory the container mounts.
+func configDir(entry *allocationEntry) (string, error) {
+	if entry.ConfigDir != "" {
+		return entry.ConfigDir, nil
+	}
+	return allocationDir(entry.AllocationId)
+}
+
+// removeAllocationDir cleans up the host directory of a released allocation.
+func removeAllocationDir(entry *allocationEntry) {
+	if entry.AllocationId == "" && entry.ConfigDir == "" {
+		return
+	}
+	dir, err := configDir(entry)
+	if err == nil {
+		err = os.RemoveAll(dir)
+	}
+	if err != nil {
+		log.Errorf("Remove the directory of allocation %s error: %s", entry.AllocationId, err)
+	}
+}
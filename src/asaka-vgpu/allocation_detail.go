@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseAsakaAllocation parses and validates the allocation detail returned by
+// GET /device/{id}.
+func parseAsakaAllocation(allocationId, detail string) (*AsakaAllocation, error) {
+	var servers []AsakaServer
+	if err := json.Unmarshal([]byte(detail), &servers); err != nil {
+		return nil, fmt.Errorf("Parse allocation %s error: %s", allocationId, err)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("Allocation %s has no asaka servers", allocationId)
+	}
+
+	for _, server := range servers {
+		if server.AllocationId != "" && server.AllocationId != allocationId {
+			return nil, fmt.Errorf("Allocation %s holds asaka server %s of allocation %s",
+				allocationId, server.ServiceName, server.AllocationId)
+		}
+		if err := validateAsakaServer(server); err != nil {
+			return nil, fmt.Errorf("Allocation %s holds invalid asaka server %s: %s",
+				allocationId, server.ServiceName, err)
+		}
+	}
+	return &AsakaAllocation{AllocationId: allocationId, Servers: servers, Raw: detail}, nil
+}
+
+// matches checks that the allocation can provide the vgpuNeeded vGPUs the
+// XaaS Controller granted on deviceIds, if it told which devices it granted.
+// A service serves at least one vGPU, more under a device quota.
+func (a *AsakaAllocation) matches(vgpuNeeded int, deviceIds []string) error {
+	services := a.Services()
+	if len(services) == 0 || len(services) > vgpuNeeded {
+		return fmt.Errorf("Allocation %s has %d services for the %d requested vGPUs",
+			a.AllocationId, len(services), vgpuNeeded)
+	}
+
+	if len(deviceIds) == 0 {
+		return nil
+	}
+	granted := append([]string(nil), deviceIds...)
+	allocated := a.DeviceIds()
+	sort.Strings(granted)
+	sort.Strings(allocated)
+	if strings.Join(granted, ",") != strings.Join(allocated, ",") {
+		return fmt.Errorf("Allocation %s is served by devices %v, %v were granted",
+			a.AllocationId, allocated, granted)
+	}
+	return nil
+}
+
+// describe lists the servers and devices of the allocation for logging.
+func (a *AsakaAllocation) describe() string {
+	var servers []string
+	for _, server := range a.Servers {
+		var devices []string
+		for _, service := range server.Services {
+			devices = append(devices, service.ServedDeviceId)
+		}
+		servers = append(servers, fmt.Sprintf("%s:%d%v", server.ServiceIp, server.ServicePort, devices))
+	}
+	return strings.Join(servers, ", ")
+}
+
+// signature lists the fields of the allocation the plugin relies on: the
+// allocation ID, the address of each server and the devices of its services.
+func (a *AsakaAllocation) signature() string {
+	var servers []string
+	for _, server := range a.Servers {
+		var devices []string
+		for _, service := range server.Services {
+			devices = append(devices, service.ServedDeviceId)
+		}
+		sort.Strings(devices)
+		servers = append(servers, fmt.Sprintf("%s:%d[%s]", server.ServiceIp, server.ServicePort, strings.Join(devices, ",")))
+	}
+	sort.Strings(servers)
+	return a.AllocationId + " " + strings.Join(servers, " ")
+}
+
+// sameAllocation reports whether two details of an allocation agree on the
+// fields the plugin relies on, ignoring the others. It fails when either
+// detail can't be parsed.
+func sameAllocation(allocationId, baseline, detail string) (bool, error) {
+	before, err := parseAsakaAllocation(allocationId, baseline)
+	if err != nil {
+		return false, err
+	}
+	after, err := parseAsakaAllocation(allocationId, detail)
+	if err != nil {
+		return false, err
+	}
+	return before.signature() == after.signature(), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	queueInitialBackoff = 200 * time.Millisecond
+	queueMaxBackoff     = 2 * time.Second
+
+	// queuePolicyFifo serves the waiting allocations in arrival order.
+	queuePolicyFifo = "fifo"
+	// queuePolicySmallestFirst serves the waiting allocations asking for
+	// the fewest vGPUs first, as they are the most likely to fit.
+	queuePolicySmallestFirst = "smallest-first"
+)
+
+var errNotEnoughVGPU = errors.New("Not enough asaka vGPU left. Please wait")
+
+type queueTicket struct {
+	seq        int
+	vgpuNeeded int
+	enqueued   time.Time
+	deadline   time.Time
+	turn       chan struct{}
+}
+
+// allocationQueue holds the Allocate calls waiting for the vGPU pool of the
+// XaaS Controller to free up. Only the ticket at the head of the queue asks
+// the controller again, so waiting allocations are served in policy order.
+type allocationQueue struct {
+	policy   string
+	maxDepth int
+	maxWait  time.Duration
+
+	mu      sync.Mutex
+	seq     int
+	waiting []*queueTicket
+}
+
+func newAllocationQueue(policy string, maxDepth int, maxWait time.Duration) *allocationQueue {
+	q := &allocationQueue{}
+	q.Configure(policy, maxDepth, maxWait)
+	allocationQueueDepth.Set(0)
+	return q
+}
+
+// Configure changes the settings of the queue. Waiting allocations keep their
+// deadline.
+func (q *allocationQueue) Configure(policy string, maxDepth int, maxWait time.Duration) {
+	if policy != queuePolicySmallestFirst {
+		policy = queuePolicyFifo
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.policy = policy
+	q.maxDepth = maxDepth
+	q.maxWait = maxWait
+}
+
+// Do runs request, and keeps retrying it with backoff while the controller
+// reports that the pool is exhausted, until the queue deadline passes.
+func (q *allocationQueue) Do(vgpuNeeded int, request func() ([]AsakaServer, error)) ([]AsakaServer, error) {
+	q.mu.Lock()
+	if len(q.waiting) == 0 {
+		q.mu.Unlock()
+		asakaServers, err := request()
+		if err != errNotEnoughVGPU {
+			return asakaServers, err
+		}
+		q.mu.Lock()
+	}
+	if q.maxWait <= 0 {
+		q.mu.Unlock()
+		return nil, errNotEnoughVGPU
+	}
+
+	if len(q.waiting) >= q.maxDepth {
+		depth := len(q.waiting)
+		q.mu.Unlock()
+		return nil, fmt.Errorf("%s, the allocation queue is full with %d requests", errNotEnoughVGPU, depth)
+	}
+	ticket := q.enqueue(vgpuNeeded)
+	q.mu.Unlock()
+	defer q.dequeue(ticket)
+
+	backoff := queueInitialBackoff
+	for {
+		if q.isHead(ticket) {
+			asakaServers, err := request()
+			if err != errNotEnoughVGPU {
+				return asakaServers, err
+			}
+		}
+
+		remaining := ticket.deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%s, gave up after waiting %s in the allocation queue",
+				errNotEnoughVGPU, time.Since(ticket.enqueued))
+		}
+		wait := backoff
+		if wait > remaining {
+			wait = remaining
+		}
+
+		select {
+		case <-ticket.turn:
+		case <-time.After(wait):
+			if backoff *= 2; backoff > queueMaxBackoff {
+				backoff = queueMaxBackoff
+			}
+		}
+	}
+}
+
+// enqueue adds a ticket to the queue. The caller must hold mu.
+func (q *allocationQueue) enqueue(vgpuNeeded int) *queueTicket {
+	q.seq++
+	now := time.Now()
+	ticket := &queueTicket{
+		seq:        q.seq,
+		vgpuNeeded: vgpuNeeded,
+		enqueued:   now,
+		deadline:   now.Add(q.maxWait),
+		turn:       make(chan struct{}, 1),
+	}
+	q.waiting = append(q.waiting, ticket)
+	allocationQueueDepth.Set(float64(len(q.waiting)))
+	log.Infof("Allocation of %d vGPUs queued, queue depth: %d.", vgpuNeeded, len(q.waiting))
+
+	return ticket
+}
+
+func (q *allocationQueue) dequeue(ticket *queueTicket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, t := range q.waiting {
+		if t == ticket {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	allocationQueueDepth.Set(float64(len(q.waiting)))
+	allocationQueueWait.Observe(time.Since(ticket.enqueued))
+	log.Infof("Allocation of %d vGPUs left the queue after %s, queue depth: %d.",
+		ticket.vgpuNeeded, time.Since(ticket.enqueued), len(q.waiting))
+
+	// Wake up the next ticket so that it asks the controller right away.
+	if head := q.head(); head != nil {
+		select {
+		case head.turn <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *allocationQueue) isHead(ticket *queueTicket) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.head() == ticket
+}
+
+// head returns the ticket to be served next. The caller must hold mu.
+func (q *allocationQueue) head() *queueTicket {
+	var head *queueTicket
+	for _, t := range q.waiting {
+		if head == nil || q.before(t, head) {
+			head = t
+		}
+	}
+	return head
+}
+
+func (q *allocationQueue) before(a, b *queueTicket) bool {
+	if q.policy == queuePolicySmallestFirst && a.vgpuNeeded != b.vgpuNeeded {
+		return a.vgpuNeeded < b.vgpuNeeded
+	}
+	return a.seq < b.seq
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForDepth waits until depth allocations wait in q.
+func waitForDepth(t *testing.T, q *allocationQueue, depth int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.mu.Lock()
+		waiting := len(q.waiting)
+		q.mu.Unlock()
+		if waiting == depth {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Queue depth is %d, want %d", waiting, depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAllocationQueueOrder(t *testing.T) {
+	tests := []struct {
+		policy   string
+		requests []int
+		want     []int
+	}{
+		{
+			policy:   queuePolicyFifo,
+			requests: []int{4, 1, 2, 1},
+			want:     []int{4, 1, 2, 1},
+		},
+		{
+			policy:   queuePolicySmallestFirst,
+			requests: []int{4, 1, 2, 1},
+			want:     []int{1, 1, 2, 4},
+		},
+		{
+			// Smallest-first keeps the arrival order of equal requests.
+			policy:   queuePolicySmallestFirst,
+			requests: []int{2, 3, 2},
+			want:     []int{2, 2, 3},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %v", test.policy, test.requests), func(t *testing.T) {
+			q := newAllocationQueue(test.policy, len(test.requests), 10*time.Second)
+
+			var mu sync.Mutex
+			var served []int
+			free := false
+			request := func(vgpuNeeded int) func() ([]AsakaServer, error) {
+				return func() ([]AsakaServer, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					if !free {
+						return nil, errNotEnoughVGPU
+					}
+					served = append(served, vgpuNeeded)
+					return []AsakaServer{{}}, nil
+				}
+			}
+
+			var wg sync.WaitGroup
+			for i, vgpuNeeded := range test.requests {
+				wg.Add(1)
+				go func(vgpuNeeded int) {
+					defer wg.Done()
+					if _, err := q.Do(vgpuNeeded, request(vgpuNeeded)); err != nil {
+						t.Errorf("Allocation of %d vGPUs error: %s", vgpuNeeded, err)
+					}
+				}(vgpuNeeded)
+				waitForDepth(t, q, i+1)
+			}
+
+			mu.Lock()
+			free = true
+			mu.Unlock()
+			wg.Wait()
+
+			if !reflect.DeepEqual(served, test.want) {
+				t.Errorf("Served %v, want %v", served, test.want)
+			}
+			waitForDepth(t, q, 0)
+		})
+	}
+}
+
+func TestAllocationQueueLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDepth int
+		maxWait  time.Duration
+		waiting  int
+		wantErr  string
+	}{
+		{
+			name:     "queueing disabled",
+			maxDepth: 4,
+			maxWait:  0,
+			wantErr:  errNotEnoughVGPU.Error(),
+		},
+		{
+			name:     "queue full",
+			maxDepth: 2,
+			maxWait:  time.Minute,
+			waiting:  2,
+			wantErr:  "the allocation queue is full with 2 requests",
+		},
+		{
+			name:     "deadline passed",
+			maxDepth: 4,
+			maxWait:  50 * time.Millisecond,
+			wantErr:  "gave up after waiting",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newAllocationQueue(queuePolicyFifo, test.maxDepth, test.maxWait)
+			// Allocations already waiting, they never get to the head.
+			for i := 0; i < test.waiting; i++ {
+				q.waiting = append(q.waiting, &queueTicket{seq: -i, vgpuNeeded: 1})
+			}
+
+			start := time.Now()
+			_, err := q.Do(1, func() ([]AsakaServer, error) {
+				return nil, errNotEnoughVGPU
+			})
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Do error = %v, want %q", err, test.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed < test.maxWait && test.waiting == 0 {
+				t.Errorf("Do gave up after %s, before the %s deadline", elapsed, test.maxWait)
+			}
+			waitForDepth(t, q, test.waiting)
+		})
+	}
+}
+
+func TestAllocationQueueServesOnceFree(t *testing.T) {
+	q := newAllocationQueue(queuePolicyFifo, 4, 10*time.Second)
+
+	attempts := 0
+	servers, err := q.Do(1, func() ([]AsakaServer, error) {
+		if attempts++; attempts < 3 {
+			return nil, errNotEnoughVGPU
+		}
+		return []AsakaServer{{AllocationId: "a"}}, nil
+	})
+	if err != nil {
+		t.Fatalf("Do error: %s", err)
+	}
+	if len(servers) != 1 || servers[0].AllocationId != "a" || attempts != 3 {
+		t.Errorf("Do = %v after %d attempts, want allocation a after 3", servers, attempts)
+	}
+	waitForDepth(t, q, 0)
+}
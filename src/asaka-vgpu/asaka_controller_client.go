@@ -2,30 +2,53 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
 )
 
+// unexpectedStatusError is returned when the XaaS Controller answers with a
+// status code outside of 2xx.
+type unexpectedStatusError struct {
+	statusCode int
+}
+
+func (e *unexpectedStatusError) Error() string {
+	return fmt.Sprintf("Unexpected response codes: %d", e.statusCode)
+}
+
+// isNotFound reports whether err means the requested controller object is gone.
+func isNotFound(err error) bool {
+	statusErr, ok := err.(*unexpectedStatusError)
+	return ok && (statusErr.statusCode == http.StatusNotFound || statusErr.statusCode == http.StatusGone)
+}
+
+// isUnreachable reports whether err means the XaaS Controller can't serve
+// requests, as opposed to rejecting a single one.
+func isUnreachable(err error) bool {
+	statusErr, ok := err.(*unexpectedStatusError)
+	return !ok || statusErr.statusCode >= http.StatusInternalServerError
+}
+
 func handleHttpGet(queryUrl string) (string, error) {
-	response, err := http.Get(queryUrl)
+	response, err := controllerHttpClient.Get(queryUrl)
 	if err != nil {
 		return "", err
 	}
+	defer response.Body.Close()
 
 	if response.StatusCode > 299 {
-		errorMessage := fmt.Sprintf("Unexpected response codes: %d", response.StatusCode)
-		return "", errors.New(errorMessage)
+		return "", &unexpectedStatusError{statusCode: response.StatusCode}
 	}
 
-	defer response.Body.Close()
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return "", err
@@ -35,14 +58,20 @@ func handleHttpGet(queryUrl string) (string, error) {
 }
 
 func handleHttpPut(url string, data string) (string, error) {
-	client := &http.Client{}
 	request, err := http.NewRequest("PUT", url, strings.NewReader(data))
-	response, err := client.Do(request)
 	if err != nil {
 		return "", err
 	}
-
+	response, err := controllerHttpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
 	defer response.Body.Close()
+
+	if response.StatusCode > 299 {
+		return "", &unexpectedStatusError{statusCode: response.StatusCode}
+	}
+
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return "", err
@@ -51,88 +80,475 @@ func handleHttpPut(url string, data string) (string, error) {
 	return string(body), nil
 }
 
-type releaseInfo struct {
-	allocationId  string
-	allocationStr string
-}
-
 type AsakaControllerClient struct {
 	xaasControllerUri string
-	releaseMap        map[int]releaseInfo
+	baseUrl           string
+	ledger            *allocationLedger
+	vgpuIds           *vgpuIdMap
+	queue             *allocationQueue
+	capabilities      controllerCapabilities
+	quarantine        payloadQuarantine
+	connection        controllerConnection
+
+	devicesListing  pagedResource
+	servicesListing pagedResource
+	inventory       inventoryCache
+
+	mu       sync.Mutex
+	capacity map[string]int
+	draining map[string]bool
 }
 
-func NewAsakaControllerClient(controllerUri string) *AsakaControllerClient {
-	return &AsakaControllerClient{
-		xaasControllerUri: controllerUri,
-		releaseMap:        make(map[int]releaseInfo),
+// inventoryCache holds the last inventory built by GetDevices together with
+// the versions of the inputs it was built from.
+type inventoryCache struct {
+	mu               sync.Mutex
+	valid            bool
+	config           *PluginConfig
+	devicesVersion   int
+	servicesVersion  int
+	ledgerGeneration int
+	devs             []*pluginapi.Device
+}
+
+func NewAsakaControllerClient(config *PluginConfig) (*AsakaControllerClient, error) {
+	httpClient, scheme, err := newControllerHttpClient(config.ControllerTLS)
+	if err != nil {
+		return nil, err
+	}
+	controllerHttpClient = &http.Client{
+		Transport: instrumentTransport(httpClient.Transport),
+		Timeout:   config.ControllerTimeout,
 	}
+
+	queue := newAllocationQueue(config.AllocationQueuePolicy,
+		config.AllocationQueueDepth, config.AllocationQueueTimeout)
+
+	return &AsakaControllerClient{
+		xaasControllerUri: config.ControllerUri,
+		baseUrl:           scheme + "://" + config.ControllerUri,
+		ledger:            newAllocationLedger(ledgerFile),
+		vgpuIds:           newVgpuIdMap(vgpuIdMapFile),
+		queue:             queue,
+		connection:        controllerConnection{lost: make(chan struct{}, 1)},
+		capacity:          make(map[string]int),
+		draining:          make(map[string]bool),
+	}, nil
+}
+
+// url returns the URL of an endpoint of the XaaS Controller.
+func (ac *AsakaControllerClient) url(format string, args ...interface{}) string {
+	return ac.baseUrl + fmt.Sprintf(format, args...)
 }
 
-func (ac *AsakaControllerClient) AllocateVGPU(devs []string) (map[string]string, error) {
+func (ac *AsakaControllerClient) AllocateVGPU(devs []string) (*pluginapi.ContainerAllocateResponse, error) {
 	vgpuNeeded := len(devs)
-	log.Infof("Request %d VGPUs.", vgpuNeeded)
+	slots := ac.vgpuIds.Slots(devs)
+	log.Infof("Request %d VGPUs: %v", vgpuNeeded, slots)
 	if vgpuNeeded > 0 {
-		queryUrl := fmt.Sprintf("http://%s/service/asaka_server?served_protocol=CUDA&vgpu_request=%d", ac.xaasControllerUri, vgpuNeeded)
-		log.Infof("Query the XaaS Controller for asaka service: %s", queryUrl)
-		returnStr, err := handleHttpGet(queryUrl)
+		unlock := ac.ledger.Lock(devs)
+		defer unlock()
+
+		entry, ok, err := ac.reuseAllocation(devs)
 		if err != nil {
 			return nil, err
 		}
-		asakaServers, isDone, errorOfHandleResponse := ac.handleHttpResponse(returnStr)
-
-		if errorOfHandleResponse != nil {
-			log.Info("Error of handle response: ", errorOfHandleResponse)
-			return nil, errorOfHandleResponse
-		} else if !isDone {
-			log.Info("Error of handle response: ", errorOfHandleResponse)
-			return nil, fmt.Errorf("Cannot finsih request GPU resource from XaaS Controller")
-		} else if len(asakaServers) == 0 {
-			log.Infof("Cannot find enough vGPUs meet the requirment: %d.", vgpuNeeded)
-			return nil, fmt.Errorf("Cannot finsih request GPU resource from XaaS Controller")
-		}
-
-		envMap := map[string]string{}
-		envMap["ASAKA_K8S"] = "1"
-		envMap["XaaS-Controller"] = ac.xaasControllerUri
-		envMap["CONTROLLER_IP"] = ac.xaasControllerUri
-		envMap["ASAKA_CONTROLLER_IP"] = ac.xaasControllerUri
-
-		allocationId := asakaServers[0].AllocationId
-		if allocationId != "" {
-			log.Infof("Get the allocationId: %s", allocationId)
-			allocations := ac.queryVGPUAllocations(allocationId)
-			envMap["DEV"] = allocations + ";ALLOCATION_ID=" + allocationId
-			ac.confirmedVGPUAllocations(allocationId)
-			key := StringsToHash(devs)
-			if _, ok := ac.releaseMap[key]; !ok {
-				var releaseData releaseInfo
-				releaseData.allocationId = allocationId
-				releaseData.allocationStr = allocations
-				ac.releaseMap[key] = releaseData
+		if ok {
+			return containerResponse(entry)
+		}
+		return ac.allocate(devs, slots, "")
+	}
+	return &pluginapi.ContainerAllocateResponse{}, nil
+}
+
+// allocate requests a new allocation for devs from the XaaS Controller. The
+// caller must hold the ledger lock of devs. A configDir other than empty is
+// the host directory the allocation config is written to in file mode.
+func (ac *AsakaControllerClient) allocate(devs []string, slots []vgpuSlot, configDir string) (*pluginapi.ContainerAllocateResponse, error) {
+	vgpuNeeded := len(devs)
+
+	asakaServers, err := ac.queue.Do(vgpuNeeded, func() ([]AsakaServer, error) {
+		return ac.requestAsakaServers(vgpuNeeded, slots)
+	})
+	if err != nil {
+		log.Info("Error of handle response: ", err)
+		return nil, err
+	}
+
+	allocationId := asakaServers[0].AllocationId
+	if allocationId == "" {
+		envMap, err := renderEnv(&envTemplateData{
+			ControllerUri: ac.xaasControllerUri,
+			VgpuIds:       devs,
+			Servers:       asakaServers,
+		})
+		if err != nil {
+			return nil, err
+		}
+		response := &pluginapi.ContainerAllocateResponse{Envs: envMap}
+		injectClientRuntime(response, servedProtocol)
+		return response, nil
+	}
+
+	log.Infof("Get the allocationId: %s", allocationId)
+	allocation, allocations, err := ac.queryAllocation(allocationId)
+	if err == nil {
+		err = allocation.matches(vgpuNeeded, servedDeviceIds(asakaServers))
+	}
+	if err != nil {
+		abandoned := &allocationEntry{AllocationId: allocationId, AllocationStr: allocations, VgpuIds: devs, Slots: slots}
+		if releaseErr := ac.releaseEntry(devs, abandoned); releaseErr != nil {
+			log.Errorf("Release allocation %s error: %s", allocationId, releaseErr)
+		}
+		return nil, err
+	}
+	log.Infof("Allocation %s of %v is served by %s.", allocationId, slots, allocation.describe())
+
+	state, detail := allocationReserved, ""
+	if !currentConfig().TwoPhaseAllocation {
+		state = ""
+		if _, err := ac.confirmedVGPUAllocations(allocationId); err == nil {
+			state = allocationConfirmed
+			detail = ac.confirmedDetail(allocationId)
+		}
+	}
+	entry := &allocationEntry{
+		AllocationId:  allocationId,
+		AllocationStr: allocations,
+		Detail:        detail,
+		VgpuIds:       devs,
+		Slots:         slots,
+		DeviceIds:     allocation.DeviceIds(),
+		ServerIps:     serverIps(allocation.Servers),
+		Servers:       allocation.Servers,
+		ControllerUri: ac.xaasControllerUri,
+		Protocol:      servedProtocol,
+		ConfigDir:     configDir,
+		State:         state,
+		CreatedAt:     time.Now(),
+	}
+	entry.Envs, err = renderEnv(&envTemplateData{
+		AllocationId:  allocationId,
+		ControllerUri: ac.xaasControllerUri,
+		VgpuIds:       devs,
+		Slots:         slots,
+		Servers:       allocation.Servers,
+		DeviceIds:     entry.DeviceIds,
+		Allocation:    allocation,
+	})
+	if err != nil {
+		if releaseErr := ac.releaseEntry(devs, entry); releaseErr != nil {
+			log.Errorf("Release allocation %s error: %s", allocationId, releaseErr)
+		}
+		return nil, err
+	}
+	ac.ledger.Add(devs, entry)
+
+	response, err := containerResponse(entry)
+	if err != nil {
+		if releaseErr := ac.releaseEntry(devs, entry); releaseErr != nil {
+			log.Errorf("Release allocation %s error: %s", allocationId, releaseErr)
+		}
+		return nil, err
+	}
+	return response, nil
+}
+
+// requestAsakaServers asks the XaaS Controller for asaka servers providing
+// vgpuNeeded vGPUs, on the physical devices of slots if the controller
+// supports it. It returns errNotEnoughVGPU when the pool is exhausted.
+func (ac *AsakaControllerClient) requestAsakaServers(vgpuNeeded int, slots []vgpuSlot) ([]AsakaServer, error) {
+	queryUrl := ac.url("/service/asaka_server?served_protocol=%s&vgpu_request=%d", servedProtocol, vgpuNeeded)
+	if ac.capabilities.Has(featureDeviceIdAllocation) && len(slots) == vgpuNeeded {
+		deviceIds := make([]string, 0, len(slots))
+		for _, slot := range slots {
+			deviceIds = append(deviceIds, slot.DeviceId)
+		}
+		queryUrl += "&device_ids=" + url.QueryEscape(strings.Join(deviceIds, ","))
+	}
+	log.Infof("Query the XaaS Controller for asaka service: %s", queryUrl)
+	returnStr, err := handleHttpGet(queryUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	asakaServers, isDone, err := ac.handleHttpResponse(returnStr)
+	if err != nil {
+		return nil, err
+	} else if !isDone {
+		return nil, fmt.Errorf("Cannot finsih request GPU resource from XaaS Controller")
+	} else if len(asakaServers) == 0 {
+		log.Infof("Cannot find enough vGPUs meet the requirment: %d.", vgpuNeeded)
+		return nil, fmt.Errorf("Cannot finsih request GPU resource from XaaS Controller")
+	}
+
+	return asakaServers, nil
+}
+
+// reuseAllocation returns the confirmed allocation already held by devs, so
+// that Allocate calls retried by kubelet don't leak allocations. The entry is
+// only forgotten once the controller released it or no longer knows it.
+func (ac *AsakaControllerClient) reuseAllocation(devs []string) (*allocationEntry, bool, error) {
+	entry, ok := ac.ledger.Get(devs)
+	if !ok {
+		return nil, false, nil
+	}
+
+	reusable := entry.State == allocationConfirmed ||
+		(entry.State == allocationReserved && currentConfig().TwoPhaseAllocation)
+	if !reusable {
+		log.Infof("Allocation %s of %v isn't confirmed, replacing it.", entry.AllocationId, entry.Slots)
+		if err := ac.releaseEntry(devs, entry); err != nil {
+			return nil, false, fmt.Errorf("Release allocation %s error: %s", entry.AllocationId, err)
+		}
+		return nil, false, nil
+	}
+
+	if currentConfig().VerifyReusedAllocations {
+		if _, err := ac.queryVGPUAllocations(entry.AllocationId); err != nil {
+			if !isNotFound(err) {
+				return nil, false, fmt.Errorf("Query allocation %s error: %s", entry.AllocationId, err)
 			}
+			log.Infof("Allocation %s of %v is no longer live, replacing it: %s", entry.AllocationId, entry.Slots, err)
+			ac.ledger.Remove(devs)
+			removeAllocationDir(entry)
+			return nil, false, nil
 		}
-		return envMap, nil
 	}
-	return nil, nil
+
+	log.Infof("Reuse allocation %s of %v.", entry.AllocationId, entry.Slots)
+	return entry, true, nil
 }
 
-func (ac *AsakaControllerClient) ReleaseVGPU(devs []string) error {
-	key := StringsToHash(devs)
-	if releaseData, ok := ac.releaseMap[key]; ok {
-		log.Infof("Release %s, %s", releaseData.allocationId, releaseData.allocationStr)
-		url := fmt.Sprintf("http://%s/device/%s/release", ac.xaasControllerUri, releaseData.allocationId)
-		if _, err := handleHttpPut(url, releaseData.allocationStr); err != nil {
+// ConfirmVGPU confirms the reservation held by devs with the XaaS Controller.
+// An expired reservation is replaced by a new one when the container can
+// follow it, see reserveAgain.
+func (ac *AsakaControllerClient) ConfirmVGPU(devs []string) error {
+	unlock := ac.ledger.Lock(devs)
+	defer unlock()
+
+	entry, ok := ac.ledger.Get(devs)
+	if !ok {
+		// The reservation was reaped or released, the container must not
+		// start on an allocation the plugin no longer holds.
+		return fmt.Errorf("No reservation of vGPUs %v, it expired or was released", devs)
+	}
+	if entry.State == allocationConfirmed {
+		return nil
+	}
+
+	expired := entry.State == allocationExpired
+	if !expired {
+		if _, err := ac.queryVGPUAllocations(entry.AllocationId); err != nil {
+			if !isNotFound(err) {
+				return fmt.Errorf("Query reservation %s error: %s", entry.AllocationId, err)
+			}
+			log.Warnf("Reservation %s of %v expired: %s", entry.AllocationId, entry.Slots, err)
+			expired = true
+		}
+	}
+	if expired {
+		var err error
+		if entry, err = ac.reserveAgain(devs, entry); err != nil {
 			return err
 		}
-		delete(ac.releaseMap, key)
+	}
+
+	if _, err := ac.confirmedVGPUAllocations(entry.AllocationId); err != nil {
+		return err
+	}
+	detail := ac.confirmedDetail(entry.AllocationId)
+	ac.ledger.Update(devs, func(e *allocationEntry) {
+		e.State = allocationConfirmed
+		e.Detail = detail
+	})
+	log.Infof("Confirmed allocation %s of %v.", entry.AllocationId, entry.Slots)
+
+	return nil
+}
+
+// reserveAgain replaces the expired reservation of devs by a new one. Only the
+// allocation config file mounted into the container can follow the new
+// allocation, in env mode the container start fails so that kubelet allocates
+// again.
+func (ac *AsakaControllerClient) reserveAgain(devs []string, expired *allocationEntry) (*allocationEntry, error) {
+	dir, err := configDir(expired)
+	if err != nil || currentConfig().AllocationConfigMode != allocationConfigFile {
+		if err := ac.releaseEntry(devs, expired); err != nil {
+			log.Errorf("Release allocation %s error: %s", expired.AllocationId, err)
+		}
+		return nil, fmt.Errorf("Reservation %s of vGPUs %v expired", expired.AllocationId, devs)
+	}
+
+	log.Infof("Reservation %s of %v expired, reserving again.", expired.AllocationId, expired.Slots)
+	ac.ledger.Remove(devs)
+	if _, err := ac.allocate(devs, expired.Slots, dir); err != nil {
+		ac.releaseExpired(expired)
+		return nil, fmt.Errorf("Reserve again vGPUs %v error: %s", devs, err)
+	}
+	entry, ok := ac.ledger.Get(devs)
+	if !ok {
+		ac.releaseExpired(expired)
+		return nil, fmt.Errorf("Reserve again vGPUs %v error: no allocation ID returned", devs)
+	}
+	if err := ac.releaseAllocation(expired); err != nil {
+		log.Errorf("Release allocation %s error: %s", expired.AllocationId, err)
+	}
+	log.Infof("Reserved %s again as %s, rewrote the allocation config in %s.", expired.AllocationId, entry.AllocationId, dir)
+	return entry, nil
+}
+
+// releaseExpired releases an expired reservation that couldn't be replaced,
+// along with its host directory.
+func (ac *AsakaControllerClient) releaseExpired(expired *allocationEntry) {
+	if err := ac.releaseAllocation(expired); err != nil {
+		log.Errorf("Release allocation %s error: %s", expired.AllocationId, err)
+	}
+	removeAllocationDir(expired)
+}
+
+// confirmedDetail returns the detail of a just confirmed allocation, the
+// baseline ValidateVGPU compares the controller's view with.
+func (ac *AsakaControllerClient) confirmedDetail(allocationId string) string {
+	detail, err := ac.queryVGPUAllocations(allocationId)
+	if err != nil {
+		log.Infof("Query confirmed allocation %s error: %s", allocationId, err)
+	}
+	return detail
+}
+
+// ValidateVGPU checks that the confirmed allocations held by devs are still
+// live on the XaaS Controller and weren't reassigned since their confirmation.
+func (ac *AsakaControllerClient) ValidateVGPU(devs []string) error {
+	for _, entry := range ac.ledger.EntriesWithin(devs) {
+		if entry.State == allocationRevoked {
+			return fmt.Errorf("Allocation %s of vGPUs %v was revoked by the XaaS Controller: %s",
+				entry.AllocationId, entry.VgpuIds, entry.RevokedReason)
+		}
+		if entry.State != allocationConfirmed {
+			continue
+		}
+
+		detail, err := ac.queryVGPUAllocations(entry.AllocationId)
+		if err != nil {
+			if isNotFound(err) {
+				return fmt.Errorf("Allocation %s of vGPUs %v is no longer live on the XaaS Controller: %s",
+					entry.AllocationId, entry.VgpuIds, err)
+			}
+			// Only a definite answer of the controller fails the start.
+			log.Warnf("Cannot validate allocation %s of %v, letting the container start: %s",
+				entry.AllocationId, entry.Slots, err)
+			continue
+		}
+
+		baseline := entry.Detail
+		if baseline == "" {
+			baseline = entry.AllocationStr
+		}
+		same, err := sameAllocation(entry.AllocationId, baseline, detail)
+		if err != nil {
+			log.Warnf("Cannot validate allocation %s of %v, letting the container start: %s",
+				entry.AllocationId, entry.Slots, err)
+			continue
+		}
+		if !same {
+			return fmt.Errorf("Allocation %s of vGPUs %v no longer matches the XaaS Controller, expected %s but got %s",
+				entry.AllocationId, entry.VgpuIds, baseline, detail)
+		}
+		log.Infof("Allocation %s of %v is still live.", entry.AllocationId, entry.Slots)
+	}
+
+	return nil
+}
+
+// ReapReservations releases the reservations that weren't confirmed within
+// the reservation timeout, until stop is closed.
+func (ac *AsakaControllerClient) ReapReservations(stop <-chan interface{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(currentConfig().PollInterval):
+		}
+
+		timeout := currentConfig().ReservationTimeout
+		for _, entry := range ac.ledger.Entries() {
+			if entry.State != allocationReserved || time.Since(entry.CreatedAt) < timeout {
+				continue
+			}
+
+			unlock := ac.ledger.Lock(entry.VgpuIds)
+			if current, ok := ac.ledger.Get(entry.VgpuIds); ok && current.AllocationId == entry.AllocationId &&
+				current.State == allocationReserved {
+				log.Infof("Reservation %s of %v wasn't confirmed within %s, releasing it.",
+					entry.AllocationId, entry.Slots, timeout)
+				if err := ac.expireReservation(entry.VgpuIds, current); err != nil {
+					log.Errorf("Release reservation %s error: %s", entry.AllocationId, err)
+				}
+			}
+			unlock()
+		}
+	}
+}
+
+// expireReservation releases an unconfirmed reservation. In file mode the entry
+// is kept as expired, the container set up with it may still start and
+// reserve again.
+func (ac *AsakaControllerClient) expireReservation(devs []string, entry *allocationEntry) error {
+	if currentConfig().AllocationConfigMode != allocationConfigFile {
+		return ac.releaseEntry(devs, entry)
+	}
+	if err := ac.releaseAllocation(entry); err != nil {
+		return err
+	}
+	ac.ledger.Update(devs, func(e *allocationEntry) {
+		e.State = allocationExpired
+	})
+	return nil
+}
+
+func (ac *AsakaControllerClient) ReleaseVGPU(devs []string) error {
+	unlock := ac.ledger.Lock(devs)
+	defer unlock()
+
+	if releaseData, ok := ac.ledger.Get(devs); ok {
+		return ac.releaseEntry(devs, releaseData)
 	}
 
 	return nil
 }
 
+func (ac *AsakaControllerClient) releaseEntry(devs []string, releaseData *allocationEntry) error {
+	if err := ac.releaseAllocation(releaseData); err != nil {
+		return err
+	}
+	ac.ledger.Remove(devs)
+	removeAllocationDir(releaseData)
+
+	return nil
+}
+
+// releaseAllocation releases the allocation of entry with the XaaS Controller,
+// leaving the ledger alone.
+func (ac *AsakaControllerClient) releaseAllocation(entry *allocationEntry) error {
+	log.Infof("Release %s of %v, %s", entry.AllocationId, entry.Slots, entry.AllocationStr)
+	// An expired reservation or an allocation revoked because it is gone
+	// needs no release, a reassigned one is still held on the XaaS
+	// Controller.
+	if entry.State == allocationExpired || (entry.State == allocationRevoked && entry.RevokedReason == revokedGone) {
+		return nil
+	}
+	url := ac.url("/device/%s/release", entry.AllocationId)
+	// An allocation the controller no longer knows is released already.
+	if _, err := handleHttpPut(url, entry.AllocationStr); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
 func (ac *AsakaControllerClient) handleHttpResponse(returnStr string) ([]AsakaServer, bool, error) {
 	if returnStr == "null" {
-		return nil, false, errors.New("Not enough asaka vGPU left. Please wait")
+		return nil, false, errNotEnoughVGPU
 	}
 
 	var asakaServers []AsakaServer
@@ -144,69 +560,310 @@ func (ac *AsakaControllerClient) handleHttpResponse(returnStr string) ([]AsakaSe
 		return nil, true, err
 	}
 
+	// The allocation ID names a host directory, it is never let through.
+	for _, server := range asakaServers {
+		if server.AllocationId != "" {
+			if err := validAllocationId(server.AllocationId); err != nil {
+				ac.releaseRejected(asakaServers)
+				return nil, true, err
+			}
+		}
+	}
+	// The allocation is checked in detail once queried, an invalid server
+	// only fails it in strict mode.
+	_, issues := validateAsakaServers(asakaServers)
+	for _, issue := range issues {
+		log.Warnf("Invalid %s in allocation response: %s", issue.entry, issue.reason)
+	}
+	if currentConfig().StrictValidation && len(issues) > 0 {
+		ac.releaseRejected(asakaServers)
+		return nil, true, fmt.Errorf("Invalid allocation response with %d invalid entries, first: %s", len(issues), issues[0])
+	}
+
 	return asakaServers, true, nil
 }
 
-func (ac *AsakaControllerClient) queryVGPUAllocations(allocationId string) string {
-	queryStr := fmt.Sprintf("http://%s/device/%s", ac.xaasControllerUri, allocationId)
-	returnStr, err := handleHttpGet(queryStr)
+// releaseRejected releases the allocations of a rejected allocation response,
+// the XaaS Controller created them when answering. The allocation IDs are
+// escaped as they weren't validated, the ones that can't name an allocation
+// in a URL are left to the controller.
+func (ac *AsakaControllerClient) releaseRejected(asakaServers []AsakaServer) {
+	released := make(map[string]bool)
+	for _, server := range asakaServers {
+		allocationId := server.AllocationId
+		if allocationId == "" || allocationId == "." || allocationId == ".." || released[allocationId] {
+			continue
+		}
+		released[allocationId] = true
+
+		escaped := url.PathEscape(allocationId)
+		detail, err := handleHttpGet(ac.url("/device/%s", escaped))
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			log.Infof("Query rejected allocation %q error: %s", allocationId, err)
+		}
+		log.Infof("Release rejected allocation %q.", allocationId)
+		if _, err := handleHttpPut(ac.url("/device/%s/release", escaped), detail); err != nil && !isNotFound(err) {
+			log.Errorf("Release rejected allocation %q error: %s", allocationId, err)
+		}
+	}
+}
+
+func (ac *AsakaControllerClient) queryVGPUAllocations(allocationId string) (string, error) {
+	queryStr := ac.url("/device/%s", allocationId)
+	return handleHttpGet(queryStr)
+}
+
+// queryAllocation returns the parsed allocation detail along with the raw one,
+// which is what the XaaS Controller expects back on release.
+func (ac *AsakaControllerClient) queryAllocation(allocationId string) (*AsakaAllocation, string, error) {
+	detail, err := ac.queryVGPUAllocations(allocationId)
 	if err != nil {
-		log.Info("Query allocation error: ", err)
+		return nil, "", fmt.Errorf("Query allocation %s error: %s", allocationId, err)
 	}
-	return returnStr
+	allocation, err := parseAsakaAllocation(allocationId, detail)
+	if err != nil {
+		return nil, detail, err
+	}
+	return allocation, detail, nil
 }
 
-func (ac *AsakaControllerClient) confirmedVGPUAllocations(allocationId string) string {
-	url := fmt.Sprintf("http://%s/device/%s/allocate", ac.xaasControllerUri, allocationId)
+func (ac *AsakaControllerClient) confirmedVGPUAllocations(allocationId string) (string, error) {
+	url := ac.url("/device/%s/allocate", allocationId)
 	returnStr, err := handleHttpPut(url, "")
 
 	if err != nil {
 		log.Infof("Confirm allocation %s error: %s", allocationId, err)
 	}
 
-	return returnStr
+	return returnStr, err
+}
+
+// parseOccupiedServices counts the services of each physical device the XaaS
+// Controller reports as occupied.
+func (ac *AsakaControllerClient) parseOccupiedServices(pages []string) (map[string]int, error) {
+	var asakaServers []AsakaServer
+	for _, page := range pages {
+		var pageServers []AsakaServer
+		if err := json.Unmarshal([]byte(page), &pageServers); err != nil {
+			return nil, err
+		}
+		asakaServers = append(asakaServers, pageServers...)
+	}
+	asakaServers, issues := validateAsakaServers(asakaServers)
+	if err := ac.quarantine.check("/service/asaka_server", issues); err != nil {
+		return nil, err
+	}
+
+	occupied := make(map[string]int)
+	for _, server := range asakaServers {
+		for _, service := range server.Services {
+			if service.Occupied {
+				occupied[service.ServedDeviceId]++
+			}
+		}
+	}
+	return occupied, nil
+}
+
+func (ac *AsakaControllerClient) parseDevices(pages []string) ([]Device, error) {
+	var devices []Device
+	for _, page := range pages {
+		var pageDevices []Device
+		if err := json.Unmarshal([]byte(page), &pageDevices); err != nil {
+			return nil, err
+		}
+		devices = append(devices, pageDevices...)
+	}
+	devices, issues := validateDevices(devices)
+	if err := ac.quarantine.check("/device", issues); err != nil {
+		return nil, err
+	}
+	return devices, nil
 }
 
 func (ac *AsakaControllerClient) GetDevices() []*pluginapi.Device {
-	queryUrl := fmt.Sprintf("http://%s/device", ac.xaasControllerUri)
-	returnStr, err := handleHttpGet(queryUrl)
+	if !ac.Connected() {
+		return ac.degradedInventory()
+	}
+	devs, err := ac.Inventory()
 	if err != nil {
 		log.Error(err)
-		return nil
+		return ac.degradedInventory()
 	}
+	return devs
+}
 
-	var devices []Device
-	if err = json.Unmarshal([]byte(returnStr), &devices); err != nil {
-		log.Error(err)
-		return nil
+// Inventory returns the vGPUs to advertise to kubelet.
+func (ac *AsakaControllerClient) Inventory() ([]*pluginapi.Device, error) {
+	queryUrl := ac.url("/device")
+	devicePages, devicesVersion, err := ac.devicesListing.fetch(queryUrl, ac.capabilities.Has(featurePagination))
+	if err != nil {
+		if isUnreachable(err) {
+			ac.connectionLost(err)
+		}
+		return nil, err
+	}
+
+	// The same endpoint allocates when given vgpu_request, it is only polled
+	// when the controller guarantees that listing it is read-only.
+	var servicePages []string
+	servicesVersion := 0
+	if ac.capabilities.Has(featureServiceListing) {
+		queryUrl = ac.url("/service/asaka_server?served_protocol=%s", servedProtocol)
+		servicePages, servicesVersion, err = ac.servicesListing.fetch(queryUrl, ac.capabilities.Has(featurePagination))
+		if err != nil {
+			log.Errorf("Query occupied services error: %s", err)
+			servicePages, servicesVersion = nil, -1
+		}
+	}
+	ledgerGeneration := ac.ledger.Generation()
+	config := currentConfig()
+
+	// The inventory is only rebuilt when one of its inputs changed.
+	cache := &ac.inventory
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.valid && cache.config == config && cache.devicesVersion == devicesVersion &&
+		cache.servicesVersion == servicesVersion && cache.ledgerGeneration == ledgerGeneration {
+		return cache.devs, nil
+	}
+
+	devices, err := ac.parseDevices(devicePages)
+	if err != nil {
+		return nil, err
+	}
+	occupied, err := ac.parseOccupiedServices(servicePages)
+	if err != nil {
+		log.Errorf("Parse occupied services error: %s", err)
 	}
 
+	cache.devs = ac.buildDevices(selectDevices(devices, config.DeviceSelector), occupied)
+	cache.config = config
+	cache.devicesVersion = devicesVersion
+	cache.servicesVersion = servicesVersion
+	cache.ledgerGeneration = ledgerGeneration
+	cache.valid = true
+
+	return cache.devs, nil
+}
+
+// buildDevices turns the controller inventory into the vGPUs advertised to
+// kubelet.
+func (ac *AsakaControllerClient) buildDevices(devices []Device, occupied map[string]int) []*pluginapi.Device {
+	owned := ac.ledger.OwnedVgpuIds()
+	revoked := ac.ledger.RevokedVgpuIds()
+	ownOccupied := ac.ledger.OccupiedByDevice()
+
 	var devs []*pluginapi.Device
+	advertised := make(map[string]bool)
 	for _, d := range devices {
-		vgpuNum := 0
-		for _, extra := range d.ExtraAttrs {
-			if extra.Key == "vgpu_num" {
-				if vgpuNum, err = strconv.Atoi(extra.Value); err != nil {
-					log.Error(err)
-				}
-				break
+		// The devices were validated, vgpu_num is well-formed.
+		vgpuNum, _ := deviceVgpuNum(d)
+
+		// Slots occupied by other clusters or bare-metal users are
+		// advertised as Unhealthy, starting from the highest index, so
+		// kubelet won't hand them out. Slots held by this node stay Healthy.
+		foreign := occupied[d.DeviceId] - ownOccupied[d.DeviceId]
+		health := make([]string, vgpuNum)
+		vgpuIDs := make([]string, vgpuNum)
+		for i := vgpuNum - 1; i >= 0; i-- {
+			vgpuID := ac.vgpuIds.IdFor(d.DeviceId, i)
+			vgpuIDs[i] = vgpuID
+			health[i] = pluginapi.Healthy
+			if revoked[vgpuID] {
+				health[i] = pluginapi.Unhealthy
+			} else if !owned[vgpuID] && foreign > 0 {
+				health[i] = pluginapi.Unhealthy
+				foreign--
 			}
 		}
+		ac.recordCapacity(d.DeviceId, vgpuNum, owned)
+		if foreign > 0 {
+			log.Warnf("Device %s has %d more occupied services than free vGPUs.", d.DeviceId, foreign)
+		}
+
 		for i := 0; i < vgpuNum; i++ {
-			vgpuID := d.DeviceId + ":" + strconv.Itoa(i)
-			log.Debug("vgpuID: ", vgpuID)
+			log.Debug("vgpuID: ", vgpuIDs[i], ", health: ", health[i])
+			advertised[vgpuIDs[i]] = true
 			devs = append(devs, &pluginapi.Device{
-				ID:     vgpuID,
-				Health: pluginapi.Healthy,
+				ID:     vgpuIDs[i],
+				Health: health[i],
 			})
 		}
 	}
 
+	return append(devs, ac.drainingDevices(advertised, owned)...)
+}
+
+// recordCapacity logs a capacity-change event when the vgpu_num of a device
+// differs from the previous poll.
+func (ac *AsakaControllerClient) recordCapacity(deviceId string, vgpuNum int, owned map[string]bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	previous, known := ac.capacity[deviceId]
+	ac.capacity[deviceId] = vgpuNum
+	if !known || previous == vgpuNum {
+		return
+	}
+
+	inUse := 0
+	for vgpuID := range owned {
+		if slot, ok := ac.vgpuIds.Lookup(vgpuID); ok && slot.DeviceId == deviceId && slot.Index >= vgpuNum {
+			inUse++
+		}
+	}
+	log.Infof("Capacity of device %s changed from %d to %d vGPUs, %d removed vGPUs still in use.",
+		deviceId, previous, vgpuNum, inUse)
+}
+
+// drainingDevices keeps the vGPUs that are no longer part of the inventory but
+// still held by allocations of this node advertised as Unhealthy, so kubelet's
+// accounting stays consistent until they are released.
+func (ac *AsakaControllerClient) drainingDevices(advertised map[string]bool, owned map[string]bool) []*pluginapi.Device {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	var devs []*pluginapi.Device
+	for vgpuID := range owned {
+		if advertised[vgpuID] {
+			continue
+		}
+		if !ac.draining[vgpuID] {
+			log.Infof("vGPU %s was removed from the inventory but is still in use, draining.", vgpuID)
+			ac.draining[vgpuID] = true
+		}
+		devs = append(devs, &pluginapi.Device{
+			ID:     vgpuID,
+			Health: pluginapi.Unhealthy,
+		})
+	}
+
+	for vgpuID := range ac.draining {
+		if !owned[vgpuID] {
+			log.Infof("vGPU %s was released, dropping it from the inventory.", vgpuID)
+			delete(ac.draining, vgpuID)
+		} else if advertised[vgpuID] {
+			log.Infof("vGPU %s is back in the inventory.", vgpuID)
+			delete(ac.draining, vgpuID)
+		}
+	}
+
 	return devs
 }
 
+// TestConnection checks that the XaaS Controller is reachable and negotiates
+// its capabilities.
 func (ac *AsakaControllerClient) TestConnection() error {
-	queryStr := fmt.Sprintf("http://%s/test", ac.xaasControllerUri)
-	_, err := handleHttpGet(queryStr)
-	return err
+	queryStr := ac.url("/test")
+	if _, err := handleHttpGet(queryStr); err != nil {
+		return err
+	}
+	if err := ac.Negotiate(); err != nil {
+		return err
+	}
+	ac.setConnected()
+	return nil
 }
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"encoding/json"
+)
+
 type AsakaServer struct {
 	ServiceIp    string          `json:"service_ip"`
 	ServiceName  string          `json:"service_name"`
@@ -36,6 +40,45 @@ type ExtraAttr struct {
 	Value string `json:"value"`
 }
 
+// AsakaAllocation is an allocation as detailed by the XaaS Controller. A
+// service serves one or more vGPUs, depending on the quota of its device.
+type AsakaAllocation struct {
+	AllocationId string
+	Servers      []AsakaServer
+	// Raw is the detail as returned by the XaaS Controller, including the
+	// fields the plugin doesn't model.
+	Raw string
+}
+
+// Services returns the services of the allocation.
+func (a *AsakaAllocation) Services() []*AsakaService {
+	var services []*AsakaService
+	for _, server := range a.Servers {
+		services = append(services, server.Services...)
+	}
+	return services
+}
+
+// DeviceIds returns the physical devices serving the allocation.
+func (a *AsakaAllocation) DeviceIds() []string {
+	return servedDeviceIds(a.Servers)
+}
+
+// String renders the servers of the allocation the way the Asaka client
+// expects them in DEV, as returned by the XaaS Controller.
+func (a *AsakaAllocation) String() string {
+	if a.Raw != "" {
+		return a.Raw
+	}
+	servers, _ := json.Marshal(a.Servers)
+	return string(servers)
+}
+
+// DevString renders the legacy DEV value of the allocation.
+func (a *AsakaAllocation) DevString() string {
+	return a.String() + ";ALLOCATION_ID=" + a.AllocationId
+}
+
 type AsakaError struct {
 	ErrorMsg string `json:"Error"`
 }
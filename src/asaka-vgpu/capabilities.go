@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// controllerApiMajor is the major API version of the XaaS Controller this
+// plugin speaks. Controllers of another major version are refused.
+const controllerApiMajor = 1
+
+// Optional features reported by the XaaS Controller in GET /version.
+const (
+	// featureDeviceIdAllocation means the controller allocates on the
+	// physical devices picked by the plugin.
+	featureDeviceIdAllocation = "device_id_allocation"
+	// featureServiceListing means GET /service/asaka_server without
+	// vgpu_request lists the asaka servers without allocating anything.
+	featureServiceListing = "service_listing"
+	// featurePagination means the controller paginates its listings.
+	featurePagination = "pagination"
+)
+
+// usedFeatures are the optional features the plugin makes use of, the others
+// reported by the controller are ignored.
+var usedFeatures = map[string]bool{
+	featureDeviceIdAllocation: true,
+	featureServiceListing:     true,
+	featurePagination:         true,
+}
+
+// errNotConnected is reported until the first connection to the XaaS
+// Controller.
+var errNotConnected = errors.New("Not connected to the XaaS Controller yet")
+
+// incompatibleControllerError is returned for a XaaS Controller speaking
+// another major API version.
+type incompatibleControllerError struct {
+	apiVersion string
+}
+
+func (e *incompatibleControllerError) Error() string {
+	return fmt.Sprintf("XaaS Controller API version %s is incompatible, this plugin requires v%d",
+		e.apiVersion, controllerApiMajor)
+}
+
+// controllerVersion is the answer of GET /version.
+type controllerVersion struct {
+	ApiVersion string   `json:"api_version"`
+	Features   []string `json:"features"`
+}
+
+// controllerCapabilities records the API version and the features of the XaaS
+// Controller negotiated at the last handshake.
+type controllerCapabilities struct {
+	mu         sync.RWMutex
+	apiVersion string
+	features   map[string]bool
+}
+
+// Has reports whether the controller supports feature.
+func (c *controllerCapabilities) Has(feature string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.features[feature]
+}
+
+// ApiVersion returns the API version of the controller, empty for controllers
+// predating the handshake.
+func (c *controllerCapabilities) ApiVersion() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.apiVersion
+}
+
+func (c *controllerCapabilities) set(apiVersion string, features []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.apiVersion = apiVersion
+	c.features = make(map[string]bool, len(features))
+	for _, feature := range features {
+		c.features[feature] = true
+	}
+}
+
+// Negotiate records the API version and the features of the XaaS Controller.
+// It fails when the controller speaks an incompatible API version.
+func (ac *AsakaControllerClient) Negotiate() error {
+	queryStr := ac.url("/version")
+	returnStr, err := handleHttpGet(queryStr)
+	if isNotFound(err) {
+		log.Infof("XaaS Controller doesn't report its API version, assuming v%d without optional features.", controllerApiMajor)
+		ac.capabilities.set("", nil)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Query XaaS Controller version error: %s", err)
+	}
+
+	var version controllerVersion
+	if err := json.Unmarshal([]byte(returnStr), &version); err != nil {
+		return fmt.Errorf("Parse XaaS Controller version error: %s", err)
+	}
+	major, err := apiMajor(version.ApiVersion)
+	if err != nil {
+		return err
+	}
+	if major != controllerApiMajor {
+		return &incompatibleControllerError{apiVersion: version.ApiVersion}
+	}
+
+	var features []string
+	for _, feature := range version.Features {
+		if usedFeatures[feature] {
+			features = append(features, feature)
+		}
+	}
+	sort.Strings(features)
+	ac.capabilities.set(version.ApiVersion, features)
+	log.Infof("XaaS Controller API version %s, features used: %v", version.ApiVersion, features)
+	return nil
+}
+
+func apiMajor(apiVersion string) (int, error) {
+	major := strings.SplitN(strings.TrimPrefix(apiVersion, "v"), ".", 2)[0]
+	value, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid XaaS Controller API version: %q", apiVersion)
+	}
+	return value, nil
+}
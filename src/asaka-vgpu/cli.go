@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+const usage = `Usage: asaka-vgpu <command> [flags]
+
+Commands:
+  serve            Run the device plugin (default)
+  version          Print the version
+  validate-config  Check the config without contacting the XaaS Controller
+  inventory        Print the vGPUs that would be advertised to kubelet
+
+Run "asaka-vgpu <command> -h" for the flags of a command.
+`
+
+// configFlags are the settings given on the command line. They take
+// precedence over the env vars and the config file.
+type configFlags struct {
+	configFile    string
+	controllerUri string
+	logLevel      string
+	kubeletDir    string
+	resourceName  string
+	socketName    string
+}
+
+var commandLine configFlags
+
+func (f *configFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.configFile, "config", os.Getenv("ASAKA_CONFIG_FILE"), "JSON config file (ASAKA_CONFIG_FILE)")
+	flags.StringVar(&f.controllerUri, "controller", "", "address of the XaaS Controller (XAAS_CONTROLLER_URI)")
+	flags.StringVar(&f.logLevel, "log-level", "", "one of debug, info, warn and error (LOG_LEVEL)")
+	flags.StringVar(&f.kubeletDir, "kubelet-dir", "", "kubelet device plugin directory (ASAKA_KUBELET_DIR)")
+	flags.StringVar(&f.resourceName, "resource-name", "", "extended resource advertised to kubelet (ASAKA_RESOURCE_NAME)")
+	flags.StringVar(&f.socketName, "socket-name", "", "name of the plugin socket (ASAKA_SOCKET_NAME)")
+}
+
+// apply overrides the settings of c given on the command line.
+func (f *configFlags) apply(c *PluginConfig) {
+	for target, value := range map[*string]string{
+		&c.ControllerUri: f.controllerUri,
+		&c.LogLevel:      f.logLevel,
+		&c.KubeletDir:    f.kubeletDir,
+		&c.ResourceName:  f.resourceName,
+		&c.SocketName:    f.socketName,
+	} {
+		if value != "" {
+			*target = value
+		}
+	}
+}
+
+// runCommand runs the command of the command line and returns the exit code.
+func runCommand(args []string) int {
+	command, defaulted := "serve", true
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		command, args, defaulted = args[0], args[1:], false
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.Usage = func() {
+		// Without a command, -h asks about the whole tool.
+		if defaulted {
+			fmt.Fprintf(os.Stderr, "%s\nFlags of %s, the default command:\n", usage, command)
+		} else {
+			fmt.Fprintf(os.Stderr, "Usage: asaka-vgpu %s [flags]\n", command)
+		}
+		flags.PrintDefaults()
+	}
+
+	var run func() error
+	switch command {
+	case "serve":
+		commandLine.register(flags)
+		run = serve
+	case "version":
+		run = func() error {
+			fmt.Printf("asaka-vgpu %s, %s %s/%s\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+			return nil
+		}
+	case "validate-config":
+		commandLine.register(flags)
+		run = validateConfig
+	case "inventory":
+		commandLine.register(flags)
+		run = func() error {
+			return printInventory(os.Stdout)
+		}
+	case "help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n\n%s", command, usage)
+		return 2
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %v\n", flags.Args())
+		return 2
+	}
+
+	// Only serve logs to stdout, the other commands print their result there.
+	if command != "serve" {
+		log.SetOutput(os.Stderr)
+	}
+	if err := run(); err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
+
+func validateConfig() error {
+	if err := initConfig(); err != nil {
+		return err
+	}
+	config := currentConfig()
+	if config.ConfigFile != "" {
+		fmt.Printf("Config %s is valid.\n", config.ConfigFile)
+	} else {
+		fmt.Println("Config is valid.")
+	}
+	return nil
+}
+
+// printInventory prints the vGPUs that would be advertised to kubelet.
+func printInventory(w io.Writer) error {
+	if err := initConfig(); err != nil {
+		return err
+	}
+	if err := initControllerClient(); err != nil {
+		return err
+	}
+	// The serving plugin owns the state directory.
+	asakaControllerClient.vgpuIds.SetReadOnly()
+
+	devs, err := asakaControllerClient.Inventory()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VGPU ID\tDEVICE\tINDEX\tHEALTH")
+	for _, dev := range devs {
+		slot, _ := asakaControllerClient.vgpuIds.Lookup(dev.ID)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", dev.ID, slot.DeviceId, slot.Index, dev.Health)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// clientRuntime describes the Asaka client runtime injected into the
+// containers, so that stock CUDA images work without the interposition
+// library baked in.
+type clientRuntime struct {
+	Mounts        []*clientRuntimeMount  `json:"mounts"`
+	Devices       []*clientRuntimeDevice `json:"devices"`
+	LdLibraryPath []string               `json:"ld_library_path"`
+	LdPreload     []string               `json:"ld_preload"`
+	Envs          map[string]string      `json:"envs"`
+}
+
+type clientRuntimeMount struct {
+	HostPath      string `json:"host_path"`
+	ContainerPath string `json:"container_path"`
+	ReadOnly      bool   `json:"read_only"`
+}
+
+type clientRuntimeDevice struct {
+	HostPath      string `json:"host_path"`
+	ContainerPath string `json:"container_path"`
+	Permissions   string `json:"permissions"`
+}
+
+// loadClientRuntimes reads the client runtimes from ClientRuntimeFile, unless
+// they are set in the config file, and fills in their defaults.
+func (c *PluginConfig) loadClientRuntimes() error {
+	runtimes := c.ClientRuntimes
+	if runtimes == nil && c.ClientRuntimeFile != "" {
+		data, err := ioutil.ReadFile(c.ClientRuntimeFile)
+		if err != nil {
+			return fmt.Errorf("Read client runtime file %s error: %s", c.ClientRuntimeFile, err)
+		}
+		if err := json.Unmarshal(data, &runtimes); err != nil {
+			return fmt.Errorf("Parse client runtime file %s error: %s", c.ClientRuntimeFile, err)
+		}
+	}
+	for key, runtime := range runtimes {
+		if runtime == nil {
+			return fmt.Errorf("Client runtime %s is empty", key)
+		}
+		for _, mount := range runtime.Mounts {
+			if mount.HostPath == "" {
+				return fmt.Errorf("Client runtime %s has a mount without host path", key)
+			}
+			if mount.ContainerPath == "" {
+				mount.ContainerPath = mount.HostPath
+			}
+		}
+		for _, device := range runtime.Devices {
+			if device.HostPath == "" {
+				return fmt.Errorf("Client runtime %s has a device without host path", key)
+			}
+			if device.ContainerPath == "" {
+				device.ContainerPath = device.HostPath
+			}
+			if device.Permissions == "" {
+				device.Permissions = "rw"
+			}
+		}
+	}
+	c.ClientRuntimes = runtimes
+	return nil
+}
+
+// clientRuntimeFor returns the client runtime of the resource, falling back
+// to the one of the served protocol. Allocations recorded before the protocol
+// was recorded are CUDA allocations.
+func clientRuntimeFor(protocol string) *clientRuntime {
+	if protocol == "" {
+		protocol = servedProtocol
+	}
+	config := currentConfig()
+	if runtime, ok := config.ClientRuntimes[config.ResourceName]; ok {
+		return runtime
+	}
+	return config.ClientRuntimes[protocol]
+}
+
+// injectClientRuntime adds the mounts, devices and env of the client runtime
+// to a container response.
+func injectClientRuntime(response *pluginapi.ContainerAllocateResponse, protocol string) {
+	runtime := clientRuntimeFor(protocol)
+	if runtime == nil {
+		return
+	}
+
+	for _, mount := range runtime.Mounts {
+		response.Mounts = append(response.Mounts, &pluginapi.Mount{
+			ContainerPath: mount.ContainerPath,
+			HostPath:      mount.HostPath,
+			ReadOnly:      mount.ReadOnly,
+		})
+	}
+	for _, device := range runtime.Devices {
+		response.Devices = append(response.Devices, &pluginapi.DeviceSpec{
+			ContainerPath: device.ContainerPath,
+			HostPath:      device.HostPath,
+			Permissions:   device.Permissions,
+		})
+	}
+
+	if response.Envs == nil {
+		response.Envs = make(map[string]string)
+	}
+	for k, v := range runtime.Envs {
+		response.Envs[k] = v
+	}
+	if len(runtime.LdLibraryPath) > 0 {
+		response.Envs["LD_LIBRARY_PATH"] = strings.Join(runtime.LdLibraryPath, ":")
+	}
+	if len(runtime.LdPreload) > 0 {
+		response.Envs["LD_PRELOAD"] = strings.Join(runtime.LdPreload, ":")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+const (
+	defaultResourceName = "asaka/vgpu"
+	defaultSocketName   = "asaka-vgpu.sock"
+)
+
+// PluginConfig holds the tunables of the plugin.
+type PluginConfig struct {
+	// ConfigFile is the JSON file the config was read from, its settings
+	// take precedence over the env vars.
+	ConfigFile string `json:"-"`
+
+	// LogLevel is one of debug, info, warn and error.
+	LogLevel string `json:"log_level"`
+
+	// ControllerUri is the host and port of the XaaS Controller.
+	ControllerUri string `json:"controller_uri"`
+	// ControllerTLS configures TLS towards the XaaS Controller.
+	ControllerTLS ControllerTLS `json:"controller_tls"`
+	// ControllerTimeout bounds each request to the XaaS Controller, so that a
+	// hung controller can't hold up stopping the plugin.
+	ControllerTimeout time.Duration `json:"-"`
+
+	// KubeletDir is the kubelet device plugin directory, holding the
+	// kubelet socket and the plugin socket.
+	KubeletDir string `json:"kubelet_dir"`
+	// ResourceName is the extended resource advertised to kubelet.
+	ResourceName string `json:"resource_name"`
+	// SocketName is the name of the plugin socket in the kubelet device
+	// plugin directory.
+	SocketName string `json:"socket_name"`
+	// PollInterval is how often the inventory is polled from the XaaS
+	// Controller.
+	PollInterval time.Duration `json:"-"`
+	// DeviceSelector only advertises the vGPUs of the devices whose fields
+	// or extra attributes hold the given values.
+	DeviceSelector map[string]string `json:"device_selector"`
+
+	// VerifyReusedAllocations checks with the XaaS Controller that an
+	// allocation is still live before handing it out again to kubelet.
+	VerifyReusedAllocations bool `json:"verify_reused_allocations"`
+
+	// AllocationQueueTimeout is how long an allocation waits for the vGPU
+	// pool to free up. It must stay within kubelet's RPC timeout, zero
+	// disables the queue.
+	AllocationQueueTimeout time.Duration `json:"-"`
+	// AllocationQueueDepth is the maximum number of waiting allocations.
+	AllocationQueueDepth int `json:"allocation_queue_depth"`
+	// AllocationQueuePolicy is the order waiting allocations are served in.
+	AllocationQueuePolicy string `json:"allocation_queue_policy"`
+
+	// TwoPhaseAllocation only reserves allocations in Allocate and confirms
+	// them in PreStartContainer, right before the container starts.
+	TwoPhaseAllocation bool `json:"two_phase_allocation"`
+	// ReservationTimeout is how long a reservation may stay unconfirmed
+	// before it is released.
+	ReservationTimeout time.Duration `json:"-"`
+
+	// PreStartValidation checks in PreStartContainer that the allocations
+	// of the container are still live on the XaaS Controller.
+	PreStartValidation bool `json:"prestart_validation"`
+
+	// RevocationCheckInterval is how often the confirmed allocations are
+	// checked for revocation by the XaaS Controller, zero disables the
+	// check.
+	RevocationCheckInterval time.Duration `json:"-"`
+	// RevocationMarkers writes a marker file into the host directory of
+	// revoked allocations.
+	RevocationMarkers bool `json:"revocation_markers"`
+	// AllocationHostDir is the host directory holding one directory per
+	// allocation.
+	AllocationHostDir string `json:"allocation_host_dir"`
+
+	// AllocationConfigMode is how the allocation is delivered to the
+	// container, either in env vars or in a file mounted from the
+	// allocation host directory.
+	AllocationConfigMode string `json:"allocation_config_mode"`
+	// AllocationConfigMountPath is where the allocation host directory is
+	// mounted in the container in file mode.
+	AllocationConfigMountPath string `json:"allocation_config_mount_path"`
+
+	// ClientRuntimeFile is the JSON file describing the Asaka client
+	// runtime injected into the containers.
+	ClientRuntimeFile string `json:"client_runtime_file"`
+	// ClientRuntimes describe the Asaka client runtime, keyed by resource
+	// name or served protocol. They are read from ClientRuntimeFile unless
+	// set in the config file.
+	ClientRuntimes map[string]*clientRuntime `json:"client_runtimes"`
+
+	// AnnotationPrefix prefixes the container annotations describing the
+	// allocation.
+	AnnotationPrefix string `json:"annotation_prefix"`
+
+	// EnvTemplatesFile is the JSON file mapping the env var names set in
+	// the containers to the templates of their values.
+	EnvTemplatesFile string `json:"env_templates_file"`
+	// EnvTemplateTexts are the templates of the container env. They are
+	// read from EnvTemplatesFile unless set in the config file.
+	EnvTemplateTexts map[string]string `json:"env_templates"`
+	// EnvTemplates are the parsed templates of the container env.
+	EnvTemplates map[string]*template.Template `json:"-"`
+
+	// StatusAddress is the address of the HTTP listener serving /healthz and
+	// /readyz, empty disables it.
+	StatusAddress string `json:"status_address"`
+	// MetricsAddress is the address of the HTTP listener serving the
+	// Prometheus metrics, empty disables it.
+	MetricsAddress string `json:"metrics_address"`
+
+	// WatchdogInterval is how often the plugin checks that it still answers
+	// on its socket, zero disables the watchdog.
+	WatchdogInterval time.Duration `json:"-"`
+
+	// DrainTimeout is how long stopping the plugin waits for the in-flight
+	// Allocate and Release calls.
+	DrainTimeout time.Duration `json:"-"`
+
+	// StrictValidation fails a whole controller payload holding an invalid
+	// entry, instead of quarantining the entry.
+	StrictValidation bool `json:"strict_validation"`
+}
+
+// ControllerTLS configures TLS towards the XaaS Controller.
+type ControllerTLS struct {
+	Enabled            bool   `json:"enabled"`
+	CaFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// configDurations are the durations of the config file, written like "30s".
+type configDurations struct {
+	PollInterval            *configDuration `json:"poll_interval"`
+	AllocationQueueTimeout  *configDuration `json:"allocation_queue_timeout"`
+	ReservationTimeout      *configDuration `json:"reservation_timeout"`
+	RevocationCheckInterval *configDuration `json:"revocation_check_interval"`
+	WatchdogInterval        *configDuration `json:"watchdog_interval"`
+	DrainTimeout            *configDuration `json:"drain_timeout"`
+	ControllerTimeout       *configDuration `json:"controller_timeout"`
+}
+
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("Duration must be a string like \"30s\": %s", data)
+	}
+	value, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(value)
+	return nil
+}
+
+// UnmarshalJSON overrides the config with the settings of a config file.
+func (c *PluginConfig) UnmarshalJSON(data []byte) error {
+	type plainConfig PluginConfig
+	if err := json.Unmarshal(data, (*plainConfig)(c)); err != nil {
+		return err
+	}
+
+	var durations configDurations
+	if err := json.Unmarshal(data, &durations); err != nil {
+		return err
+	}
+	for target, value := range map[*time.Duration]*configDuration{
+		&c.PollInterval:            durations.PollInterval,
+		&c.AllocationQueueTimeout:  durations.AllocationQueueTimeout,
+		&c.ReservationTimeout:      durations.ReservationTimeout,
+		&c.RevocationCheckInterval: durations.RevocationCheckInterval,
+		&c.WatchdogInterval:        durations.WatchdogInterval,
+		&c.DrainTimeout:            durations.DrainTimeout,
+		&c.ControllerTimeout:       durations.ControllerTimeout,
+	} {
+		if value != nil {
+			*target = time.Duration(*value)
+		}
+	}
+	return nil
+}
+
+var pluginConfig atomic.Value
+
+// currentConfig returns the config in effect. A config is never modified once
+// in effect, reloads replace it.
+func currentConfig() *PluginConfig {
+	return pluginConfig.Load().(*PluginConfig)
+}
+
+func setConfig(c *PluginConfig) {
+	pluginConfig.Store(c)
+}
+
+func loadConfigFromEnv() *PluginConfig {
+	return &PluginConfig{
+		LogLevel:                envString("LOG_LEVEL", "info"),
+		ControllerUri:           envString("XAAS_CONTROLLER_URI", ""),
+		ControllerTimeout:       envDuration("ASAKA_CONTROLLER_TIMEOUT", 30*time.Second),
+		KubeletDir:              envString("ASAKA_KUBELET_DIR", pluginapi.DevicePluginPath),
+		ResourceName:            envString("ASAKA_RESOURCE_NAME", defaultResourceName),
+		SocketName:              envString("ASAKA_SOCKET_NAME", defaultSocketName),
+		PollInterval:            envDuration("ASAKA_POLL_INTERVAL", time.Second),
+		VerifyReusedAllocations: envBool("ASAKA_VERIFY_REUSED_ALLOCATIONS", false),
+		AllocationQueueTimeout:  envDuration("ASAKA_ALLOCATION_QUEUE_TIMEOUT", 20*time.Second),
+		AllocationQueueDepth:    envInt("ASAKA_ALLOCATION_QUEUE_DEPTH", 16),
+		AllocationQueuePolicy:   envString("ASAKA_ALLOCATION_QUEUE_POLICY", queuePolicyFifo),
+		TwoPhaseAllocation:      envBool("ASAKA_TWO_PHASE_ALLOCATION", false),
+		ReservationTimeout:      envDuration("ASAKA_RESERVATION_TIMEOUT", 10*time.Minute),
+		PreStartValidation:      envBool("ASAKA_PRESTART_VALIDATION", false),
+		RevocationCheckInterval: envDuration("ASAKA_REVOCATION_CHECK_INTERVAL", 30*time.Second),
+		RevocationMarkers:       envBool("ASAKA_REVOCATION_MARKERS", false),
+		AllocationHostDir:       envString("ASAKA_ALLOCATION_HOST_DIR", "/var/run/asaka"),
+
+		AllocationConfigMode:      envString("ASAKA_ALLOCATION_CONFIG_MODE", allocationConfigEnv),
+		AllocationConfigMountPath: envString("ASAKA_ALLOCATION_CONFIG_MOUNT_PATH", "/etc/asaka"),
+		ClientRuntimeFile:         envString("ASAKA_CLIENT_RUNTIME_FILE", ""),
+		AnnotationPrefix:          envString("ASAKA_ANNOTATION_PREFIX", "asaka.io/"),
+		EnvTemplatesFile:          envString("ASAKA_ENV_TEMPLATES_FILE", ""),
+		StrictValidation:          envBool("ASAKA_STRICT_VALIDATION", false),
+		StatusAddress:             envString("ASAKA_STATUS_ADDRESS", ""),
+		MetricsAddress:            envString("ASAKA_METRICS_ADDRESS", ""),
+		WatchdogInterval:          envDuration("ASAKA_WATCHDOG_INTERVAL", 10*time.Second),
+		DrainTimeout:              envDuration("ASAKA_DRAIN_TIMEOUT", 20*time.Second),
+	}
+}
+
+// loadConfig reads the config from the env vars, overridden by the settings of
+// configFile if any and by the command line, and checks it. The config file is
+// JSON, no YAML parser is vendored.
+func loadConfig(configFile string) (*PluginConfig, error) {
+	c := loadConfigFromEnv()
+	c.ConfigFile = configFile
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("Read config file %s error: %s", configFile, err)
+		}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("Parse config file %s error: %s", configFile, err)
+		}
+	}
+	commandLine.apply(c)
+
+	if err := c.loadFiles(); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFiles reads the config files the config points to.
+func (c *PluginConfig) loadFiles() error {
+	if err := c.loadClientRuntimes(); err != nil {
+		return err
+	}
+	return c.loadEnvTemplates()
+}
+
+func (c *PluginConfig) validate() error {
+	if c.ControllerUri == "" {
+		return fmt.Errorf("XAAS_CONTROLLER_URI can't be empty")
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("Invalid log level %q", c.LogLevel)
+	}
+	if c.KubeletDir == "" || c.ResourceName == "" || c.SocketName == "" {
+		return fmt.Errorf("Kubelet directory, resource name and socket name can't be empty")
+	}
+	if c.PollInterval <= 0 {
+		return fmt.Errorf("Invalid poll interval %s", c.PollInterval)
+	}
+	if c.AllocationQueueTimeout < 0 || c.ReservationTimeout <= 0 || c.RevocationCheckInterval < 0 {
+		return fmt.Errorf("Invalid timeouts: allocation queue %s, reservation %s, revocation check %s",
+			c.AllocationQueueTimeout, c.ReservationTimeout, c.RevocationCheckInterval)
+	}
+	if c.ControllerTimeout <= 0 {
+		return fmt.Errorf("Invalid controller timeout %s", c.ControllerTimeout)
+	}
+	if c.WatchdogInterval < 0 || c.DrainTimeout < 0 {
+		return fmt.Errorf("Invalid watchdog interval %s or drain timeout %s", c.WatchdogInterval, c.DrainTimeout)
+	}
+	if c.AllocationQueueDepth < 0 {
+		return fmt.Errorf("Invalid allocation queue depth %d", c.AllocationQueueDepth)
+	}
+	if c.AllocationQueuePolicy != queuePolicyFifo && c.AllocationQueuePolicy != queuePolicySmallestFirst {
+		return fmt.Errorf("Invalid allocation queue policy %q", c.AllocationQueuePolicy)
+	}
+	if c.AllocationConfigMode != allocationConfigEnv && c.AllocationConfigMode != allocationConfigFile {
+		return fmt.Errorf("Invalid allocation config mode %q", c.AllocationConfigMode)
+	}
+	tls := c.ControllerTLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		return fmt.Errorf("Controller TLS needs both a cert file and a key file")
+	}
+	return c.checkEnvTemplates()
+}
+
+func envBool(name string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func envString(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadConfig applies the changes of the config file to the running plugin,
+// an invalid config is rejected. It returns true when the changes need the
+// plugin to register again with kubelet.
+func reloadConfig() bool {
+	current := currentConfig()
+	next, err := loadConfig(current.ConfigFile)
+	if err != nil {
+		log.Errorf("Rejected the new config, keeping the running one: %s", err)
+		return false
+	}
+	if next.ControllerUri != current.ControllerUri || next.ControllerTLS != current.ControllerTLS {
+		log.Warnf("Changing the XaaS Controller needs a restart of the plugin, keeping %s.", current.ControllerUri)
+		next.ControllerUri, next.ControllerTLS = current.ControllerUri, current.ControllerTLS
+	}
+	if next.ControllerTimeout != current.ControllerTimeout {
+		log.Warnf("Changing the controller timeout needs a restart of the plugin, keeping %s.", current.ControllerTimeout)
+		next.ControllerTimeout = current.ControllerTimeout
+	}
+	if next.KubeletDir != current.KubeletDir {
+		log.Warnf("Changing the kubelet directory needs a restart of the plugin, keeping %s.", current.KubeletDir)
+		next.KubeletDir = current.KubeletDir
+	}
+	// The directories of the live allocations are cleaned up on release.
+	if next.AllocationHostDir != current.AllocationHostDir {
+		log.Warnf("Changing the allocation host directory needs a restart of the plugin, keeping %s.", current.AllocationHostDir)
+		next.AllocationHostDir = current.AllocationHostDir
+	}
+	if next.StatusAddress != current.StatusAddress {
+		log.Warnf("Changing the status address needs a restart of the plugin, keeping %q.", current.StatusAddress)
+		next.StatusAddress = current.StatusAddress
+	}
+	if next.MetricsAddress != current.MetricsAddress {
+		log.Warnf("Changing the metrics address needs a restart of the plugin, keeping %q.", current.MetricsAddress)
+		next.MetricsAddress = current.MetricsAddress
+	}
+	if sameConfig(current, next) {
+		return false
+	}
+
+	setConfig(next)
+	setLogLevel(next.LogLevel)
+	asakaControllerClient.queue.Configure(next.AllocationQueuePolicy,
+		next.AllocationQueueDepth, next.AllocationQueueTimeout)
+	log.Infof("Reloaded config %s.", next.ConfigFile)
+
+	if next.ResourceName != current.ResourceName || next.SocketName != current.SocketName ||
+		preStartRequired(next) != preStartRequired(current) {
+		log.Info("The new config changes the registration with kubelet, restarting.")
+		return true
+	}
+	return false
+}
+
+// sameConfig compares two configs, ignoring their parsed templates.
+func sameConfig(a, b *PluginConfig) bool {
+	copyA, copyB := *a, *b
+	copyA.EnvTemplates, copyB.EnvTemplates = nil, nil
+	return reflect.DeepEqual(copyA, copyB)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+const (
+	reconnectInitialBackoff = time.Second
+	reconnectMaxBackoff     = 30 * time.Second
+)
+
+// controllerConnection tracks whether the XaaS Controller is reachable.
+type controllerConnection struct {
+	mu        sync.Mutex
+	connected bool
+	lastErr   error
+	lost      chan struct{}
+}
+
+// Connected reports whether the XaaS Controller is reachable.
+func (ac *AsakaControllerClient) Connected() bool {
+	return ac.ConnectionError() == nil
+}
+
+// ConnectionError returns why the XaaS Controller is unreachable, nil when it
+// is reachable.
+func (ac *AsakaControllerClient) ConnectionError() error {
+	c := &ac.connection
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.connected {
+		return nil
+	}
+	if c.lastErr == nil {
+		return errNotConnected
+	}
+	return c.lastErr
+}
+
+func (ac *AsakaControllerClient) setConnected() {
+	c := &ac.connection
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.connected {
+		log.Info("Connected to the XaaS Controller.")
+	}
+	c.connected = true
+	c.lastErr = nil
+}
+
+// connectionLost switches to degraded mode until KeepConnected reconnects.
+func (ac *AsakaControllerClient) connectionLost(err error) {
+	c := &ac.connection
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.connected {
+		log.Warnf("Lost the connection to the XaaS Controller, advertising the vGPUs as Unhealthy: %s", err)
+		select {
+		case c.lost <- struct{}{}:
+		default:
+		}
+	}
+	c.connected = false
+	c.lastErr = err
+}
+
+// KeepConnected reconnects to the XaaS Controller with backoff whenever the
+// connection is lost, until stop is closed.
+func (ac *AsakaControllerClient) KeepConnected(stop <-chan interface{}) {
+	backoff := reconnectInitialBackoff
+	for {
+		if ac.Connected() {
+			backoff = reconnectInitialBackoff
+			select {
+			case <-stop:
+				return
+			case <-ac.connection.lost:
+			}
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		if err := ac.TestConnection(); err != nil {
+			log.Warnf("Reconnect to the XaaS Controller error, retrying in %s: %s", backoff, err)
+			ac.connectionLost(err)
+			if backoff *= 2; backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+		}
+	}
+}
+
+// degradedInventory advertises the last known vGPUs and the vGPUs held by this
+// node as Unhealthy, so that kubelet keeps the resource but doesn't hand out
+// vGPUs while the XaaS Controller is unreachable.
+func (ac *AsakaControllerClient) degradedInventory() []*pluginapi.Device {
+	ac.inventory.mu.Lock()
+	last := ac.inventory.devs
+	ac.inventory.mu.Unlock()
+
+	advertised := make(map[string]bool)
+	var ids []string
+	for _, dev := range last {
+		advertised[dev.ID] = true
+		ids = append(ids, dev.ID)
+	}
+	var owned []string
+	for id := range ac.ledger.OwnedVgpuIds() {
+		if !advertised[id] {
+			owned = append(owned, id)
+		}
+	}
+	sort.Strings(owned)
+
+	var devs []*pluginapi.Device
+	for _, id := range append(ids, owned...) {
+		devs = append(devs, &pluginapi.Device{
+			ID:     id,
+			Health: pluginapi.Unhealthy,
+		})
+	}
+	return devs
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// defaultEnvTemplates is the env contract of the Asaka client.
+var defaultEnvTemplates = map[string]string{
+	"ASAKA_K8S":           "1",
+	"XaaS-Controller":     "{{.ControllerUri}}",
+	"CONTROLLER_IP":       "{{.ControllerUri}}",
+	"ASAKA_CONTROLLER_IP": "{{.ControllerUri}}",
+	"DEV":                 "{{if .AllocationId}}{{.Allocation}};ALLOCATION_ID={{.AllocationId}}{{end}}",
+}
+
+var envTemplateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// envTemplateData is what the env templates are rendered against.
+type envTemplateData struct {
+	AllocationId  string
+	ControllerUri string
+	VgpuIds       []string
+	Slots         []vgpuSlot
+	Servers       []AsakaServer
+	DeviceIds     []string
+	// Allocation is the allocation detail returned by the XaaS Controller,
+	// it renders as the legacy DEV servers list.
+	Allocation *AsakaAllocation
+}
+
+// loadEnvTemplates parses the env templates set in the config file, or read
+// from EnvTemplatesFile, or the default ones.
+func (c *PluginConfig) loadEnvTemplates() error {
+	templates := c.EnvTemplateTexts
+	if templates == nil && c.EnvTemplatesFile != "" {
+		data, err := ioutil.ReadFile(c.EnvTemplatesFile)
+		if err != nil {
+			return fmt.Errorf("Read env templates file %s error: %s", c.EnvTemplatesFile, err)
+		}
+		templates = make(map[string]string)
+		if err := json.Unmarshal(data, &templates); err != nil {
+			return fmt.Errorf("Parse env templates file %s error: %s", c.EnvTemplatesFile, err)
+		}
+	}
+	if templates == nil {
+		templates = defaultEnvTemplates
+	}
+	c.EnvTemplateTexts = templates
+
+	c.EnvTemplates = make(map[string]*template.Template, len(templates))
+	for name, text := range templates {
+		tmpl, err := template.New(name).Funcs(envTemplateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("Parse env template %s error: %s", name, err)
+		}
+		c.EnvTemplates[name] = tmpl
+	}
+	return nil
+}
+
+// sampleEnvTemplateData are the kinds of data the env templates are rendered
+// against: an allocation, and servers the XaaS Controller returned without an
+// allocation ID.
+func sampleEnvTemplateData(controllerUri string) []*envTemplateData {
+	slots := []vgpuSlot{{DeviceId: "GPU-0", Index: 0}}
+	servers := []AsakaServer{{
+		ServiceIp:    "10.0.0.1",
+		ServicePort:  9527,
+		Services:     []*AsakaService{{ServedDeviceId: "GPU-0"}},
+		AllocationId: "sample",
+	}}
+	return []*envTemplateData{
+		{
+			AllocationId:  "sample",
+			ControllerUri: controllerUri,
+			VgpuIds:       []string{"GPU-0:0"},
+			Slots:         slots,
+			Servers:       servers,
+			DeviceIds:     []string{"GPU-0"},
+			Allocation:    &AsakaAllocation{AllocationId: "sample", Servers: servers},
+		},
+		{
+			ControllerUri: controllerUri,
+			VgpuIds:       []string{"GPU-0:0"},
+			Servers:       servers,
+		},
+	}
+}
+
+// checkEnvTemplates renders the env templates against sample data, so that a
+// template failing at render time, like one using .Allocation without checking
+// it, is rejected with the config instead of failing Allocate.
+func (c *PluginConfig) checkEnvTemplates() error {
+	for _, data := range sampleEnvTemplateData(c.ControllerUri) {
+		for name, tmpl := range c.EnvTemplates {
+			if err := tmpl.Execute(ioutil.Discard, data); err != nil {
+				return fmt.Errorf("Render env template %s error: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// renderEnv renders the container env. Variables rendering to an empty value
+// are left out.
+func renderEnv(data *envTemplateData) (map[string]string, error) {
+	templates := currentConfig().EnvTemplates
+	envMap := make(map[string]string, len(templates))
+	for name, tmpl := range templates {
+		var value bytes.Buffer
+		if err := tmpl.Execute(&value, data); err != nil {
+			return nil, fmt.Errorf("Render env %s error: %s", name, err)
+		}
+		if value.Len() > 0 {
+			envMap[name] = value.String()
+		}
+	}
+	return envMap, nil
+}
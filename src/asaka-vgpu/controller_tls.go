@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// controllerHttpClient talks to the XaaS Controller, NewAsakaControllerClient
+// sets it up from the config.
+var controllerHttpClient = &http.Client{Timeout: 30 * time.Second}
+
+// newControllerHttpClient returns the HTTP client and the URL scheme of the
+// XaaS Controller for the given TLS settings.
+func newControllerHttpClient(config ControllerTLS) (*http.Client, string, error) {
+	if !config.Enabled && config.CaFile == "" && config.CertFile == "" {
+		return http.DefaultClient, "http", nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CaFile != "" {
+		ca, err := ioutil.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("Read controller CA file %s error: %s", config.CaFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, "", fmt.Errorf("No certificate found in controller CA file %s", config.CaFile)
+		}
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("Load controller client certificate %s error: %s", config.CertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}}, "https", nil
+}
@@ -0,0 +1,51 @@
+package main
+
+// deviceField returns the value of a field or extra attribute of a device.
+func deviceField(d Device, key string) (string, bool) {
+	switch key {
+	case "device_id":
+		return d.DeviceId, true
+	case "device_name":
+		return d.Name, true
+	case "device_vendor":
+		return d.Vendor, true
+	case "device_type":
+		return d.Type, true
+	case "device_platform_vendor":
+		return d.PlatformVendor, true
+	case "device_platform_name":
+		return d.PlatformName, true
+	case "device_ip":
+		return d.Ip, true
+	case "beloned_user_id":
+		return d.BeloneTo, true
+	}
+	for _, extra := range d.ExtraAttrs {
+		if extra != nil && extra.Key == key {
+			return extra.Value, true
+		}
+	}
+	return "", false
+}
+
+// selectDevices returns the devices holding all the values of selector.
+func selectDevices(devices []Device, selector map[string]string) []Device {
+	if len(selector) == 0 {
+		return devices
+	}
+
+	var selected []Device
+	for _, d := range devices {
+		matches := true
+		for key, value := range selector {
+			if actual, ok := deviceField(d, key); !ok || actual != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			selected = append(selected, d)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+const (
+	lockFile       = stateDir + "plugin.lock"
+	handoverSocket = stateDir + "handover.sock"
+
+	// handoverTimeout covers draining the running instance.
+	handoverTimeout = time.Minute
+)
+
+// handoverState is the in-memory state the running instance hands over to the
+// instance replacing it. The allocations are read from the on-disk ledger,
+// flushed when the running instance stops.
+type handoverState struct {
+	// Inventory is the last inventory advertised to kubelet, what the new
+	// instance advertises as Unhealthy until it reaches the controller.
+	Inventory []*pluginapi.Device `json:"inventory"`
+	// Capacity is the vgpu_num of each device, to report capacity changes.
+	Capacity map[string]int `json:"capacity"`
+	// Draining are the vGPUs removed from the inventory but still in use.
+	Draining map[string]bool `json:"draining"`
+}
+
+type handoverAck struct {
+	Done bool `json:"done"`
+}
+
+// instanceLock is the node-local lock held by the running instance. The kernel
+// releases it when the process dies.
+type instanceLock struct {
+	file *os.File
+}
+
+func tryLock(path string) (*instanceLock, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, false, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return &instanceLock{file: file}, true, nil
+}
+
+// Unlock releases the lock, it may be called several times.
+func (l *instanceLock) Unlock() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// acquireInstance takes over from the running instance, if any. The returned
+// state is nil when there was no instance to hand over, the on-disk ledger is
+// then current.
+func acquireInstance() (*instanceLock, *handoverState, error) {
+	deadline := time.Now().Add(handoverTimeout)
+	for {
+		lock, ok, err := tryLock(lockFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Lock %s error: %s", lockFile, err)
+		}
+		if ok {
+			return lock, nil, nil
+		}
+
+		log.Info("Another instance is running, requesting a handover.")
+		lock, state, err := requestHandover(deadline)
+		if err == nil {
+			return lock, state, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("Handover from the running instance error: %s", err)
+		}
+		log.Infof("Handover from the running instance error, retrying: %s", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// requestHandover asks the running instance to stop and receives its state,
+// then acknowledges the handover once it holds the lock.
+func requestHandover(deadline time.Time) (*instanceLock, *handoverState, error) {
+	conn, err := net.DialTimeout("unix", handoverSocket, 5*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	var state handoverState
+	if err := json.NewDecoder(conn).Decode(&state); err != nil {
+		return nil, nil, fmt.Errorf("Receive state error: %s", err)
+	}
+
+	// The running instance releases the lock once the state is sent.
+	for {
+		lock, ok, err := tryLock(lockFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Lock %s error: %s", lockFile, err)
+		}
+		if ok {
+			if err := json.NewEncoder(conn).Encode(handoverAck{Done: true}); err != nil {
+				log.Warnf("Acknowledge handover error: %s", err)
+			}
+			log.Infof("Took over the state of the previous instance, %d vGPUs.", len(state.Inventory))
+			return lock, &state, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("Timed out waiting for %s", lockFile)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// handoverServer waits for an instance to take over from this one.
+type handoverServer struct {
+	lock     *instanceLock
+	listener net.Listener
+	requests chan net.Conn
+}
+
+func startHandoverServer(lock *instanceLock) (*handoverServer, error) {
+	// A socket left by a dead instance, the lock tells that it is stale.
+	if err := os.Remove(handoverSocket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", handoverSocket)
+	if err != nil {
+		return nil, fmt.Errorf("Listen on handover socket %s error: %s", handoverSocket, err)
+	}
+	// Once handed over, the socket path belongs to the new instance.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	h := &handoverServer{
+		lock:     lock,
+		listener: listener,
+		requests: make(chan net.Conn, 1),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case h.requests <- conn:
+			default:
+				conn.Close()
+			}
+		}
+	}()
+	return h, nil
+}
+
+func (h *handoverServer) Close() error {
+	return h.listener.Close()
+}
+
+// handOver sends the state of this instance, already stopped, over conn and
+// waits for the new instance to acknowledge it. It reports whether the lock
+// was released to the new instance.
+func (h *handoverServer) handOver(conn net.Conn) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handoverTimeout))
+
+	state := asakaControllerClient.exportState()
+	if err := json.NewEncoder(conn).Encode(state); err != nil {
+		log.Errorf("Send state to the new instance error: %s", err)
+		return false
+	}
+	h.lock.Unlock()
+
+	var ack handoverAck
+	if err := json.NewDecoder(conn).Decode(&ack); err != nil || !ack.Done {
+		log.Warnf("Handover not acknowledged by the new instance: %v", err)
+		return true
+	}
+	log.Infof("Handed the state over to the new instance, %d vGPUs.", len(state.Inventory))
+	return true
+}
+
+// exportState returns the in-memory state to hand over.
+func (ac *AsakaControllerClient) exportState() *handoverState {
+	state := &handoverState{
+		Capacity: make(map[string]int),
+		Draining: make(map[string]bool),
+	}
+	ac.inventory.mu.Lock()
+	state.Inventory = ac.inventory.devs
+	ac.inventory.mu.Unlock()
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for deviceId, vgpuNum := range ac.capacity {
+		state.Capacity[deviceId] = vgpuNum
+	}
+	for vgpuID := range ac.draining {
+		state.Draining[vgpuID] = true
+	}
+	return state
+}
+
+// importState takes over the state handed over by the previous instance. The
+// inventory is rebuilt on the next poll.
+func (ac *AsakaControllerClient) importState(state *handoverState) {
+	ac.inventory.mu.Lock()
+	ac.inventory.devs = state.Inventory
+	ac.inventory.mu.Unlock()
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for deviceId, vgpuNum := range state.Capacity {
+		ac.capacity[deviceId] = vgpuNum
+	}
+	for vgpuID := range state.Draining {
+		ac.draining[vgpuID] = true
+	}
+}
@@ -19,3 +19,25 @@ func StringsToHash(s []string) int {
 	sort.Strings(c)
 	return hash(strings.Join(c, ","))
 }
+
+func servedDeviceIds(asakaServers []AsakaServer) []string {
+	var deviceIds []string
+	for _, server := range asakaServers {
+		for _, service := range server.Services {
+			if service != nil {
+				deviceIds = append(deviceIds, service.ServedDeviceId)
+			}
+		}
+	}
+	return deviceIds
+}
+
+func serverIps(asakaServers []AsakaServer) []string {
+	var ips []string
+	for _, server := range asakaServers {
+		if server.ServiceIp != "" {
+			ips = append(ips, server.ServiceIp)
+		}
+	}
+	return ips
+}
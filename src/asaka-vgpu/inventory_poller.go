@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// inventoryPoller polls the vGPU inventory of a resource from the XaaS
+// Controller and broadcasts every change to the subscribed ListAndWatch
+// streams, so the controller load doesn't grow with the number of streams.
+type inventoryPoller struct {
+	resourceName string
+	getDevices   func() []*pluginapi.Device
+
+	mu          sync.Mutex
+	subscribers map[chan []*pluginapi.Device]bool
+	latest      []*pluginapi.Device
+	polled      bool
+
+	stop chan interface{}
+	done chan interface{}
+}
+
+func newInventoryPoller(resourceName string, getDevices func() []*pluginapi.Device) *inventoryPoller {
+	return &inventoryPoller{
+		resourceName: resourceName,
+		getDevices:   getDevices,
+		subscribers:  make(map[chan []*pluginapi.Device]bool),
+		stop:         make(chan interface{}),
+		done:         make(chan interface{}),
+	}
+}
+
+// Start polls the inventory until Stop is called.
+func (p *inventoryPoller) Start() {
+	go func() {
+		defer close(p.done)
+
+		for {
+			p.poll()
+
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(currentConfig().PollInterval):
+			}
+		}
+	}()
+}
+
+// Stop stops polling and waits for the current poll to finish.
+func (p *inventoryPoller) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *inventoryPoller) poll() {
+	devs := p.getDevices()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.polled && reflect.DeepEqual(devs, p.latest) {
+		return
+	}
+	p.latest = devs
+	p.polled = true
+	recordInventory(p.resourceName, devs)
+
+	for ch := range p.subscribers {
+		publish(ch, devs)
+	}
+}
+
+// Subscribe returns a channel receiving the latest inventory and every change
+// to it. The returned function cancels the subscription.
+func (p *inventoryPoller) Subscribe() (<-chan []*pluginapi.Device, func()) {
+	ch := make(chan []*pluginapi.Device, 1)
+
+	p.mu.Lock()
+	p.subscribers[ch] = true
+	if p.polled {
+		publish(ch, p.latest)
+	}
+	log.Infof("ListAndWatch stream subscribed to %s, %d streams.", p.resourceName, len(p.subscribers))
+	p.mu.Unlock()
+
+	return ch, func() {
+		p.mu.Lock()
+		delete(p.subscribers, ch)
+		log.Infof("ListAndWatch stream unsubscribed from %s, %d streams.", p.resourceName, len(p.subscribers))
+		p.mu.Unlock()
+	}
+}
+
+// publish replaces the snapshot pending in ch, so a slow stream only ever
+// sees the latest inventory.
+func publish(ch chan []*pluginapi.Device, devs []*pluginapi.Device) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- devs
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type allocationState string
+
+const (
+	// allocationConfirmed means the allocation was confirmed with the
+	// XaaS Controller.
+	allocationConfirmed allocationState = "confirmed"
+	// allocationReserved means the allocation was only reserved with the
+	// XaaS Controller and waits to be confirmed in PreStartContainer.
+	allocationReserved allocationState = "reserved"
+	// allocationRevoked means the XaaS Controller reclaimed the allocation.
+	allocationRevoked allocationState = "revoked"
+	// allocationExpired means the reservation was released unconfirmed, the
+	// entry is kept so that PreStartContainer reserves again for the
+	// container set up with it.
+	allocationExpired allocationState = "expired"
+)
+
+// allocationEntry records a controller allocation held by a set of vGPU IDs.
+type allocationEntry struct {
+	AllocationId  string            `json:"allocation_id"`
+	AllocationStr string            `json:"allocation"`
+	Detail        string            `json:"detail"`
+	VgpuIds       []string          `json:"vgpu_ids"`
+	Slots         []vgpuSlot        `json:"slots"`
+	DeviceIds     []string          `json:"device_ids"`
+	ServerIps     []string          `json:"server_ips"`
+	Servers       []AsakaServer     `json:"servers,omitempty"`
+	ControllerUri string            `json:"controller_uri"`
+	Protocol      string            `json:"protocol"`
+	Envs          map[string]string `json:"envs"`
+	State         allocationState   `json:"state"`
+	CreatedAt     time.Time         `json:"created_at"`
+	RevokedAt     time.Time         `json:"revoked_at,omitempty"`
+	RevokedReason string            `json:"revoked_reason,omitempty"`
+
+	// ConfigDir is the host directory mounted into the container in file
+	// mode, when it isn't the one of the allocation.
+	ConfigDir string `json:"config_dir,omitempty"`
+}
+
+// allocationLedger keeps track of the allocations made by this node, keyed by
+// the hash of the vGPU IDs kubelet asked for. It is persisted so that the
+// allocations survive restarts of the plugin.
+type allocationLedger struct {
+	mu         sync.Mutex
+	path       string
+	entries    map[int]*allocationEntry
+	generation int
+
+	keyLocks map[int]*keyLock
+}
+
+// keyLock serializes the work on a key, it is dropped once nobody holds or
+// waits for it.
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newAllocationLedger(path string) *allocationLedger {
+	l := &allocationLedger{
+		path:     path,
+		entries:  make(map[int]*allocationEntry),
+		keyLocks: make(map[int]*keyLock),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Read allocation ledger %s error: %s", path, err)
+		}
+		return l
+	}
+	if err = json.Unmarshal(data, &l.entries); err != nil {
+		log.Errorf("Parse allocation ledger %s error: %s", path, err)
+		l.entries = make(map[int]*allocationEntry)
+	}
+	log.Infof("Loaded %d allocations from %s.", len(l.entries), path)
+	return l
+}
+
+// Lock serializes the allocation work on a set of vGPU IDs. The returned
+// function releases the lock.
+func (l *allocationLedger) Lock(vgpuIds []string) func() {
+	key := StringsToHash(vgpuIds)
+
+	l.mu.Lock()
+	lock, ok := l.keyLocks[key]
+	if !ok {
+		lock = &keyLock{}
+		l.keyLocks[key] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(l.keyLocks, key)
+		}
+	}
+}
+
+// Get returns the entry recorded for the given vGPU IDs.
+func (l *allocationLedger) Get(vgpuIds []string) (*allocationEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[StringsToHash(vgpuIds)]
+	return entry, ok
+}
+
+// Add records an entry for the given vGPU IDs unless one is already present.
+func (l *allocationLedger) Add(vgpuIds []string, entry *allocationEntry) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := StringsToHash(vgpuIds)
+	if _, ok := l.entries[key]; ok {
+		return false
+	}
+	l.entries[key] = entry
+	l.changed()
+	return true
+}
+
+// Update applies update to a copy of the entry recorded for the given vGPU
+// IDs and records the copy.
+func (l *allocationLedger) Update(vgpuIds []string, update func(*allocationEntry)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := StringsToHash(vgpuIds)
+	if entry, ok := l.entries[key]; ok {
+		updated := *entry
+		update(&updated)
+		l.entries[key] = &updated
+		l.changed()
+	}
+}
+
+// EntriesWithin returns the entries whose vGPU IDs are all part of vgpuIds.
+func (l *allocationLedger) EntriesWithin(vgpuIds []string) []allocationEntry {
+	requested := make(map[string]bool)
+	for _, id := range vgpuIds {
+		requested[id] = true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entries []allocationEntry
+	for _, entry := range l.entries {
+		within := len(entry.VgpuIds) > 0
+		for _, id := range entry.VgpuIds {
+			within = within && requested[id]
+		}
+		if within {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+// Entries returns a snapshot of the recorded entries.
+func (l *allocationLedger) Entries() []allocationEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]allocationEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// Remove drops the entry recorded for the given vGPU IDs.
+func (l *allocationLedger) Remove(vgpuIds []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := StringsToHash(vgpuIds)
+	if _, ok := l.entries[key]; !ok {
+		return
+	}
+	delete(l.entries, key)
+	l.changed()
+}
+
+// changed persists the ledger after a modification. The caller must hold mu.
+func (l *allocationLedger) changed() {
+	l.generation++
+	l.save()
+}
+
+// Flush persists the ledger, e.g. before the plugin stops.
+func (l *allocationLedger) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.save()
+}
+
+// save writes the ledger to its file. The caller must hold mu.
+func (l *allocationLedger) save() {
+	data, err := json.Marshal(l.entries)
+	if err == nil {
+		err = writeFileAtomic(l.path, data)
+	}
+	if err != nil {
+		log.Errorf("Save allocation ledger %s error: %s", l.path, err)
+	}
+}
+
+// Generation changes every time an entry is added or removed.
+func (l *allocationLedger) Generation() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.generation
+}
+
+// OwnedVgpuIds returns the vGPU IDs held by allocations of this node.
+func (l *allocationLedger) OwnedVgpuIds() map[string]bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owned := make(map[string]bool)
+	for _, entry := range l.entries {
+		for _, id := range entry.VgpuIds {
+			owned[id] = true
+		}
+	}
+	return owned
+}
+
+// RevokedVgpuIds returns the vGPU IDs of the allocations revoked by the XaaS
+// Controller.
+func (l *allocationLedger) RevokedVgpuIds() map[string]bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	revoked := make(map[string]bool)
+	for _, entry := range l.entries {
+		if entry.State != allocationRevoked {
+			continue
+		}
+		for _, id := range entry.VgpuIds {
+			revoked[id] = true
+		}
+	}
+	return revoked
+}
+
+// OccupiedByDevice returns how many services of each physical device are held
+// by allocations of this node.
+func (l *allocationLedger) OccupiedByDevice() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	occupied := make(map[string]int)
+	for _, entry := range l.entries {
+		if entry.State == allocationRevoked || entry.State == allocationExpired {
+			continue
+		}
+		for _, deviceId := range entry.DeviceIds {
+			occupied[deviceId]++
+		}
+	}
+	return occupied
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"syscall"
 
-	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
-	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
 )
 
 var asakaControllerClient *AsakaControllerClient
 
 func initLogger() {
-	logLevel := os.Getenv("LOG_LEVEL")
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetOutput(os.Stdout)
+}
+
+func setLogLevel(logLevel string) {
 	switch logLevel {
 	case "debug":
 		log.SetLevel(log.DebugLevel)
@@ -25,78 +29,105 @@ func initLogger() {
 	default:
 		log.SetLevel(log.InfoLevel)
 	}
-	log.SetFormatter(&log.JSONFormatter{})
-	log.SetOutput(os.Stdout)
 }
 
-func initControllerClient() {
-	xaasControllerUri := os.Getenv("XAAS_CONTROLLER_URI")
-	if xaasControllerUri == "" {
-		log.Fatal("XAAS_CONTROLLER_URI can't be empty.")
+func initConfig() error {
+	config, err := loadConfig(commandLine.configFile)
+	if err != nil {
+		return err
 	}
+	setConfig(config)
+	setLogLevel(config.LogLevel)
+	return nil
+}
 
-	log.Infof("XaaS Controller URI: %s", xaasControllerUri)
-	asakaControllerClient = NewAsakaControllerClient(xaasControllerUri)
-	if err := asakaControllerClient.TestConnection(); err != nil {
-		log.Fatal(err)
+func initControllerClient() error {
+	config := currentConfig()
+	log.Infof("XaaS Controller URI: %s", config.ControllerUri)
+	client, err := NewAsakaControllerClient(config)
+	if err != nil {
+		return err
 	}
+	asakaControllerClient = client
+	return asakaControllerClient.TestConnection()
 }
 
-func init() {
+func main() {
 	initLogger()
-	initControllerClient()
+	os.Exit(runCommand(os.Args[1:]))
 }
 
-func main() {
-	log.Info("Starting FS watcher.")
-	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
+// serve runs the device plugin until it receives a termination signal.
+func serve() error {
+	if err := initConfig(); err != nil {
+		return err
+	}
+	lock, state, err := acquireInstance()
 	if err != nil {
-		log.Info("Failed to created FS watcher.")
-		os.Exit(1)
+		return err
 	}
-	defer watcher.Close()
+	defer lock.Unlock()
 
-	log.Info("Starting OS watcher.")
-	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-	restart := true
-	var devicePlugin *AsakaVgpuDevicePlugin
+	if err := initControllerClient(); err != nil {
+		if _, ok := err.(*incompatibleControllerError); ok || asakaControllerClient == nil {
+			return err
+		}
+		// Register anyway, so that kubelet keeps the resource while the
+		// controller comes back.
+		log.Warnf("XaaS Controller is unreachable, starting in degraded mode: %s", err)
+		asakaControllerClient.connectionLost(err)
+	}
+	if state != nil {
+		asakaControllerClient.importState(state)
+	}
+	handover, err := startHandoverServer(lock)
+	if err != nil {
+		return err
+	}
+	defer handover.Close()
 
-L:
-	for {
-		if restart {
-			if devicePlugin != nil {
-				devicePlugin.Stop()
-			}
+	done := make(chan interface{})
+	defer close(done)
+	go asakaControllerClient.KeepConnected(done)
 
-			devicePlugin = NewAsakaVgpuDevicePlugin()
-			if err := devicePlugin.Serve(); err != nil {
-				log.Info("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
-			} else {
-				restart = false
-			}
+	config := currentConfig()
+	if config.StatusAddress != "" {
+		statusServer, err := startStatusServer(config.StatusAddress)
+		if err != nil {
+			return err
 		}
+		defer statusServer.Close()
+	}
+	if config.MetricsAddress != "" {
+		metricsServer, err := startMetricsServer(config.MetricsAddress)
+		if err != nil {
+			return err
+		}
+		defer metricsServer.Close()
+	}
+	log.Info("Starting FS watcher.")
+	watched := []string{config.KubeletDir}
+	// ConfigMap updates swap a symlink in the directory of the config file.
+	configDir := ""
+	if config.ConfigFile != "" {
+		configDir = filepath.Dir(config.ConfigFile)
+		watched = append(watched, configDir)
+	}
+	watcher, err := newFSWatcher(watched...)
+	if err != nil {
+		return fmt.Errorf("Failed to created FS watcher: %s", err)
+	}
+	defer watcher.Close()
 
-		select {
-		case event := <-watcher.Events:
-			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				log.Infof("inotify: %s created, restarting.", pluginapi.KubeletSocket)
-				restart = true
-			}
+	log.Info("Starting OS watcher.")
+	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-		case err := <-watcher.Errors:
-			log.Infof("inotify: %s", err)
+	pluginSupervisor = newSupervisor(filepath.Join(config.KubeletDir, kubeletSocketName), configDir)
+	pluginSupervisor.Run(watcher, sigs, handover)
+	return nil
+}
 
-		case s := <-sigs:
-			switch s {
-			case syscall.SIGHUP:
-				log.Info("Received SIGHUP, restarting.")
-				restart = true
-			default:
-				log.Infof("Received signal \"%v\", shutting down.", s)
-				devicePlugin.Stop()
-				break L
-			}
-		}
-	}
+// isInDir reports whether file is directly in dir.
+func isInDir(file, dir string) bool {
+	return filepath.Dir(file) == filepath.Clean(dir)
 }
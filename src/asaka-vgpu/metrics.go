@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricVec is a metric family in the Prometheus text format, one series per
+// set of label values.
+type metricVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+func newMetricVec(name, kind, help string, labelNames ...string) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     make(map[string]*metricSeries),
+	}
+}
+
+// get returns the series of labels. The caller must hold mu.
+func (v *metricVec) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		if v.kind == "histogram" {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Add adds delta to a counter or gauge series.
+func (v *metricVec) Add(delta float64, labels ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.get(labels).value += delta
+}
+
+// Set sets a gauge series.
+func (v *metricVec) Set(value float64, labels ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.get(labels).value = value
+}
+
+// Reset drops all the series of a gauge computed from scratch.
+func (v *metricVec) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.series = make(map[string]*metricSeries)
+}
+
+// Observe records a duration in a histogram series.
+func (v *metricVec) Observe(d time.Duration, labels ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s := v.get(labels)
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.value += seconds
+	s.count++
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, v.labels(s.labels), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labels(s.labels, "le", formatFloat(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labels(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labels(s.labels), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labels(s.labels), s.count)
+	}
+}
+
+// labels formats the label values of a series, followed by extra name and
+// value pairs.
+func (v *metricVec) labels(values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range v.labelNames {
+		pairs = append(pairs, name+"="+quoteLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabel(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes the only characters the text format allows escaped in
+// label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	advertisedVgpus = newMetricVec("asaka_vgpu_advertised", "gauge",
+		"vGPUs advertised to kubelet.", "resource")
+	healthyVgpus = newMetricVec("asaka_vgpu_healthy", "gauge",
+		"vGPUs advertised as Healthy.", "resource")
+	unhealthyVgpus = newMetricVec("asaka_vgpu_unhealthy", "gauge",
+		"vGPUs advertised as Unhealthy.", "resource")
+	deviceVgpus = newMetricVec("asaka_vgpu_device_vgpus", "gauge",
+		"vGPUs advertised per physical device and health.", "resource", "device", "health")
+	liveAllocations = newMetricVec("asaka_vgpu_allocations", "gauge",
+		"Allocations held by the node per state.", "resource", "state")
+	operationDuration = newMetricVec("asaka_vgpu_operation_duration_seconds", "histogram",
+		"Latency of the allocate, confirm and release operations.", "resource", "operation", "result")
+	controllerRequests = newMetricVec("asaka_vgpu_controller_requests_total", "counter",
+		"Requests to the XaaS Controller per endpoint and status.", "endpoint", "method", "status")
+	listAndWatchStreams = newMetricVec("asaka_vgpu_list_and_watch_streams", "gauge",
+		"Open ListAndWatch streams.", "resource")
+	pluginRestarts = newMetricVec("asaka_vgpu_plugin_restarts_total", "counter",
+		"Restarts of the device plugin.", "resource")
+	registrations = newMetricVec("asaka_vgpu_registrations_total", "counter",
+		"Registration attempts with kubelet.", "resource", "result")
+	allocationQueueDepth = newMetricVec("asaka_vgpu_allocation_queue_depth", "gauge",
+		"Allocations waiting for vGPUs to free up.")
+	allocationQueueWait = newMetricVec("asaka_vgpu_allocation_queue_wait_seconds", "histogram",
+		"Time allocations waited in the allocation queue.")
+
+	allMetrics = []*metricVec{
+		advertisedVgpus, healthyVgpus, unhealthyVgpus, deviceVgpus, liveAllocations,
+		operationDuration, controllerRequests, listAndWatchStreams, pluginRestarts, registrations,
+		allocationQueueDepth, allocationQueueWait,
+	}
+)
+
+// result is the result label of an operation ending with err.
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// recordInventory records the vGPUs advertised for a resource.
+func recordInventory(resourceName string, devs []*pluginapi.Device) {
+	healthy := 0
+	perDevice := make(map[[2]string]int)
+	for _, dev := range devs {
+		if dev.Health == pluginapi.Healthy {
+			healthy++
+		}
+		device := "unknown"
+		if slot, ok := asakaControllerClient.vgpuIds.Lookup(dev.ID); ok {
+			device = slot.DeviceId
+		}
+		perDevice[[2]string{device, dev.Health}]++
+	}
+
+	advertisedVgpus.Set(float64(len(devs)), resourceName)
+	healthyVgpus.Set(float64(healthy), resourceName)
+	unhealthyVgpus.Set(float64(len(devs)-healthy), resourceName)
+	deviceVgpus.Reset()
+	for key, count := range perDevice {
+		deviceVgpus.Set(float64(count), resourceName, key[0], key[1])
+	}
+}
+
+// recordAllocations records the allocations of the ledger, right before a
+// scrape.
+func recordAllocations() {
+	resourceName := currentConfig().ResourceName
+	counts := map[allocationState]int{
+		allocationReserved:  0,
+		allocationConfirmed: 0,
+		allocationRevoked:   0,
+	}
+	for _, entry := range asakaControllerClient.ledger.Entries() {
+		counts[entry.State]++
+	}
+	liveAllocations.Reset()
+	for state, count := range counts {
+		liveAllocations.Set(float64(count), resourceName, string(state))
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	recordAllocations()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range allMetrics {
+		metric.write(w)
+	}
+}
+
+// instrumentedTransport counts the requests to the XaaS Controller.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func instrumentTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &instrumentedTransport{next: next}
+}
+
+func (t *instrumentedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.next.RoundTrip(request)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(response.StatusCode)
+	}
+	controllerRequests.Add(1, controllerEndpoint(request.URL.Path), request.Method, status)
+	return response, err
+}
+
+// controllerEndpoint replaces the allocation ID in the path of an endpoint of
+// the XaaS Controller, to keep the cardinality of the endpoint label low.
+func controllerEndpoint(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 1 && segments[0] == "device" {
+		segments[1] = ":id"
+	}
+	return "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+const (
+	// pageSize is the number of items requested per page from controllers
+	// that support paginated listings.
+	pageSize = 500
+
+	// nextCursorHeader is set by the controller when more pages follow.
+	nextCursorHeader = "X-Next-Cursor"
+
+	// maxPages bounds a listing whose cursors never end.
+	maxPages = 1000
+)
+
+// handleHttpGetConditional issues a GET with the validators of a previous
+// response. notModified is true when the controller answered 304.
+func handleHttpGetConditional(queryUrl, etag, lastModified string) (string, http.Header, bool, error) {
+	request, err := http.NewRequest("GET", queryUrl, nil)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		request.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	response, err := controllerHttpClient.Do(request)
+	if err != nil {
+		return "", nil, false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return "", response.Header, true, nil
+	}
+	if response.StatusCode > 299 {
+		return "", nil, false, &unexpectedStatusError{statusCode: response.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	return string(body), response.Header, false, nil
+}
+
+// pagedResource polls a listing of the XaaS Controller. It follows the
+// controller's cursors when the listing is paginated and uses conditional
+// requests for listings of a single page, so an unchanged listing costs a 304.
+type pagedResource struct {
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	pages        []string
+	digest       uint64
+	version      int
+}
+
+// fetch returns the pages of the listing and a version that only changes when
+// their content does. Pages are only requested when paginate is set, but
+// cursors are followed regardless.
+func (r *pagedResource) fetch(queryUrl string, paginate bool) ([]string, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	firstPage := queryUrl
+	if paginate {
+		var err error
+		if firstPage, err = pageUrl(queryUrl, ""); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// The validators of the first page don't cover the following pages.
+	etag, lastModified := r.etag, r.lastModified
+	if len(r.pages) != 1 {
+		etag, lastModified = "", ""
+	}
+	body, header, notModified, err := handleHttpGetConditional(firstPage, etag, lastModified)
+	if err != nil {
+		return nil, 0, err
+	}
+	if notModified {
+		return r.pages, r.version, nil
+	}
+
+	newEtag, newLastModified := header.Get("ETag"), header.Get("Last-Modified")
+	pages := []string{body}
+	hasher := fnv.New64a()
+	hasher.Write([]byte(body))
+	seen := make(map[string]bool)
+	for cursor := header.Get(nextCursorHeader); cursor != ""; cursor = header.Get(nextCursorHeader) {
+		if seen[cursor] {
+			return nil, 0, fmt.Errorf("Listing %s repeats cursor %q", queryUrl, cursor)
+		}
+		if len(pages) >= maxPages {
+			return nil, 0, fmt.Errorf("Listing %s has more than %d pages", queryUrl, maxPages)
+		}
+		seen[cursor] = true
+
+		nextPage, err := pageUrl(queryUrl, cursor)
+		if err != nil {
+			return nil, 0, err
+		}
+		if body, header, _, err = handleHttpGetConditional(nextPage, "", ""); err != nil {
+			return nil, 0, err
+		}
+		pages = append(pages, body)
+		hasher.Write([]byte(body))
+	}
+
+	r.etag, r.lastModified = newEtag, newLastModified
+	if digest := hasher.Sum64(); r.pages == nil || digest != r.digest {
+		r.digest = digest
+		r.version++
+	}
+	r.pages = pages
+
+	return r.pages, r.version, nil
+}
+
+func pageUrl(queryUrl, cursor string) (string, error) {
+	u, err := url.Parse(queryUrl)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Set("limit", strconv.Itoa(pageSize))
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePage is a page of a listing served by fakeListing.
+type fakePage struct {
+	body string
+	next string
+}
+
+// fakeListing serves the pages of a listing by cursor, and answers 304 to
+// requests carrying the current ETag.
+type fakeListing struct {
+	mu       sync.Mutex
+	etag     string
+	pages    map[string]fakePage
+	requests []string
+}
+
+func (l *fakeListing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.requests = append(l.requests, r.URL.RawQuery)
+	if l.etag != "" && r.Header.Get("If-None-Match") == l.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	page, ok := l.pages[r.URL.Query().Get("cursor")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if l.etag != "" {
+		w.Header().Set("ETag", l.etag)
+	}
+	if page.next != "" {
+		w.Header().Set(nextCursorHeader, page.next)
+	}
+	w.Write([]byte(page.body))
+}
+
+func (l *fakeListing) update(etag string, pages map[string]fakePage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.etag, l.pages, l.requests = etag, pages, nil
+}
+
+// serveListing points the controller client at listing for the test.
+func serveListing(t *testing.T, listing *fakeListing) string {
+	server := httptest.NewServer(listing)
+	client := controllerHttpClient
+	controllerHttpClient = server.Client()
+	t.Cleanup(func() {
+		controllerHttpClient = client
+		server.Close()
+	})
+	return server.URL + "/device"
+}
+
+func TestPagedResourceFetch(t *testing.T) {
+	tests := []struct {
+		name         string
+		paginate     bool
+		pages        map[string]fakePage
+		wantPages    []string
+		wantRequests []string
+		wantErr      string
+	}{
+		{
+			name:         "single listing",
+			pages:        map[string]fakePage{"": {body: "a"}},
+			wantPages:    []string{"a"},
+			wantRequests: []string{""},
+		},
+		{
+			name:     "cursor loop",
+			paginate: true,
+			pages: map[string]fakePage{
+				"":   {body: "a", next: "c1"},
+				"c1": {body: "b", next: "c2"},
+				"c2": {body: "c"},
+			},
+			wantPages:    []string{"a", "b", "c"},
+			wantRequests: []string{"limit=500", "cursor=c1&limit=500", "cursor=c2&limit=500"},
+		},
+		{
+			name: "cursor of a controller ignoring pagination",
+			pages: map[string]fakePage{
+				"":   {body: "a", next: "c1"},
+				"c1": {body: "b"},
+			},
+			wantPages:    []string{"a", "b"},
+			wantRequests: []string{"", "cursor=c1&limit=500"},
+		},
+		{
+			name:     "repeated cursor",
+			paginate: true,
+			pages: map[string]fakePage{
+				"":   {body: "a", next: "c1"},
+				"c1": {body: "b", next: "c1"},
+			},
+			wantErr: `repeats cursor "c1"`,
+		},
+		{
+			name:     "missing page",
+			paginate: true,
+			pages:    map[string]fakePage{"": {body: "a", next: "c1"}},
+			wantErr:  "404",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listing := &fakeListing{pages: test.pages}
+			queryUrl := serveListing(t, listing)
+
+			var resource pagedResource
+			pages, version, err := resource.fetch(queryUrl, test.paginate)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("fetch error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetch error: %s", err)
+			}
+			if !reflect.DeepEqual(pages, test.wantPages) || version != 1 {
+				t.Errorf("fetch = %v version %d, want %v version 1", pages, version, test.wantPages)
+			}
+			if !reflect.DeepEqual(listing.requests, test.wantRequests) {
+				t.Errorf("Requested %v, want %v", listing.requests, test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestPagedResourceFetchConditional(t *testing.T) {
+	single := map[string]fakePage{"": {body: "a"}}
+	paginated := map[string]fakePage{"": {body: "a", next: "c1"}, "c1": {body: "b"}}
+	tests := []struct {
+		name        string
+		first       map[string]fakePage
+		etag        string
+		pages       map[string]fakePage
+		wantPages   []string
+		wantVersion int
+		wantNumReqs int
+	}{
+		{
+			name:        "not modified",
+			first:       single,
+			etag:        "v1",
+			pages:       single,
+			wantPages:   []string{"a"},
+			wantVersion: 1,
+			wantNumReqs: 1,
+		},
+		{
+			name:        "modified",
+			first:       single,
+			etag:        "v2",
+			pages:       map[string]fakePage{"": {body: "b"}},
+			wantPages:   []string{"b"},
+			wantVersion: 2,
+			wantNumReqs: 1,
+		},
+		{
+			name:        "new validators of the same content",
+			first:       single,
+			etag:        "v2",
+			pages:       single,
+			wantPages:   []string{"a"},
+			wantVersion: 1,
+			wantNumReqs: 1,
+		},
+		{
+			// The validators of the first page don't cover the others.
+			name:        "several pages",
+			first:       paginated,
+			etag:        "v1",
+			pages:       paginated,
+			wantPages:   []string{"a", "b"},
+			wantVersion: 1,
+			wantNumReqs: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listing := &fakeListing{etag: "v1", pages: test.first}
+			queryUrl := serveListing(t, listing)
+
+			var resource pagedResource
+			if _, _, err := resource.fetch(queryUrl, true); err != nil {
+				t.Fatalf("First fetch error: %s", err)
+			}
+
+			listing.update(test.etag, test.pages)
+			pages, version, err := resource.fetch(queryUrl, true)
+			if err != nil {
+				t.Fatalf("fetch error: %s", err)
+			}
+			if !reflect.DeepEqual(pages, test.wantPages) || version != test.wantVersion {
+				t.Errorf("fetch = %v version %d, want %v version %d",
+					pages, version, test.wantPages, test.wantVersion)
+			}
+			if len(listing.requests) != test.wantNumReqs {
+				t.Errorf("Requested %v, want %d requests", listing.requests, test.wantNumReqs)
+			}
+		})
+	}
+}
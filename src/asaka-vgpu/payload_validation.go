@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// payloadIssue is an invalid entry of a XaaS Controller payload.
+type payloadIssue struct {
+	entry  string
+	reason string
+}
+
+func (i payloadIssue) Error() string {
+	return fmt.Sprintf("%s: %s", i.entry, i.reason)
+}
+
+// deviceVgpuNum returns the number of vGPUs of a device, zero when the device
+// doesn't report it.
+func deviceVgpuNum(d Device) (int, error) {
+	for _, extra := range d.ExtraAttrs {
+		if extra != nil && extra.Key == "vgpu_num" {
+			value, err := strconv.Atoi(extra.Value)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("Invalid vgpu_num %q", extra.Value)
+			}
+			return value, nil
+		}
+	}
+	return 0, nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// validateDevices splits the devices of GET /device into the valid ones and
+// the issues of the others. Devices sharing an ID are all invalid.
+func validateDevices(devices []Device) ([]Device, []payloadIssue) {
+	count := make(map[string]int)
+	for _, d := range devices {
+		count[d.DeviceId]++
+	}
+
+	var valid []Device
+	var issues []payloadIssue
+	for i, d := range devices {
+		entry := fmt.Sprintf("device %s", d.DeviceId)
+		var reason string
+		if d.DeviceId == "" {
+			entry = fmt.Sprintf("device #%d", i)
+			reason = "Missing device_id"
+		} else if count[d.DeviceId] > 1 {
+			reason = fmt.Sprintf("Duplicate device_id, listed %d times", count[d.DeviceId])
+		} else if d.ServicePort != 0 && !validPort(d.ServicePort) {
+			reason = fmt.Sprintf("Invalid device_port %d", d.ServicePort)
+		} else if _, err := deviceVgpuNum(d); err != nil {
+			reason = err.Error()
+		}
+
+		if reason != "" {
+			issues = append(issues, payloadIssue{entry: entry, reason: reason})
+			continue
+		}
+		valid = append(valid, d)
+	}
+	return valid, issues
+}
+
+// validateAsakaServer checks the fields of an asaka server the plugin relies
+// on.
+func validateAsakaServer(server AsakaServer) error {
+	if server.AllocationId != "" {
+		if err := validAllocationId(server.AllocationId); err != nil {
+			return err
+		}
+	}
+	if server.ServiceIp == "" {
+		return fmt.Errorf("Missing service_ip")
+	}
+	if !validPort(server.ServicePort) {
+		return fmt.Errorf("Invalid service_port %d", server.ServicePort)
+	}
+	for i, service := range server.Services {
+		if service == nil || service.ServedDeviceId == "" {
+			return fmt.Errorf("Service #%d is missing device_id", i)
+		}
+	}
+	return nil
+}
+
+// validAllocationId checks that an allocation ID can name a directory and a
+// URL path segment.
+func validAllocationId(allocationId string) error {
+	if allocationId == "" || allocationId == "." || allocationId == ".." ||
+		strings.ContainsAny(allocationId, `/\`) {
+		return fmt.Errorf("Invalid allocation_id %q", allocationId)
+	}
+	return nil
+}
+
+// validateAsakaServers splits the asaka servers of a listing into the valid
+// ones and the issues of the others. Servers sharing an address are all
+// invalid.
+func validateAsakaServers(servers []AsakaServer) ([]AsakaServer, []payloadIssue) {
+	count := make(map[string]int)
+	for _, server := range servers {
+		count[fmt.Sprintf("%s:%d", server.ServiceIp, server.ServicePort)]++
+	}
+
+	var valid []AsakaServer
+	var issues []payloadIssue
+	for _, server := range servers {
+		address := fmt.Sprintf("%s:%d", server.ServiceIp, server.ServicePort)
+		entry := fmt.Sprintf("asaka server %s (%s)", server.ServiceName, address)
+		err := validateAsakaServer(server)
+		if err == nil && count[address] > 1 {
+			err = fmt.Errorf("Duplicate address, listed %d times", count[address])
+		}
+
+		if err != nil {
+			issues = append(issues, payloadIssue{entry: entry, reason: err.Error()})
+			continue
+		}
+		valid = append(valid, server)
+	}
+	return valid, issues
+}
+
+// payloadQuarantine tracks the quarantined entries of each controller
+// payload, so that every entry is reported once when it enters and once when
+// it leaves the quarantine.
+type payloadQuarantine struct {
+	mu      sync.Mutex
+	entries map[string]map[string]string
+}
+
+// check reports the issues of a payload. In strict mode an invalid entry fails
+// the whole payload.
+func (q *payloadQuarantine) check(payload string, issues []payloadIssue) error {
+	q.update(payload, issues)
+	if currentConfig().StrictValidation && len(issues) > 0 {
+		return fmt.Errorf("Invalid %s payload with %d invalid entries, first: %s", payload, len(issues), issues[0])
+	}
+	return nil
+}
+
+func (q *payloadQuarantine) update(payload string, issues []payloadIssue) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.entries == nil {
+		q.entries = make(map[string]map[string]string)
+	}
+	previous := q.entries[payload]
+	current := make(map[string]string, len(issues))
+	for _, issue := range issues {
+		current[issue.entry] = issue.reason
+		if previous[issue.entry] != issue.reason {
+			log.Warnf("Quarantined %s of %s: %s", issue.entry, payload, issue.reason)
+		}
+	}
+
+	var released []string
+	for entry := range previous {
+		if _, ok := current[entry]; !ok {
+			released = append(released, entry)
+		}
+	}
+	sort.Strings(released)
+	for _, entry := range released {
+		log.Infof("Released %s of %s from quarantine.", entry, payload)
+	}
+	q.entries[payload] = current
+}
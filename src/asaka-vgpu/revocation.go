@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// revocationMarker is written into the host directory of a revoked allocation
+// so that workloads mounting it can notice the revocation.
+type revocationMarker struct {
+	AllocationId string    `json:"allocation_id"`
+	VgpuIds      []string  `json:"vgpu_ids"`
+	Reason       string    `json:"reason"`
+	RevokedAt    time.Time `json:"revoked_at"`
+}
+
+// WatchRevocations periodically checks the confirmed allocations of the
+// ledger against the XaaS Controller, until stop is closed.
+func (ac *AsakaControllerClient) WatchRevocations(stop <-chan interface{}) {
+	for {
+		// The check may be enabled by a config reload.
+		interval := currentConfig().RevocationCheckInterval
+		wait := interval
+		if interval <= 0 {
+			wait = currentConfig().PollInterval
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+		if interval <= 0 {
+			continue
+		}
+
+		for _, entry := range ac.ledger.Entries() {
+			if entry.State != allocationConfirmed {
+				continue
+			}
+			if reason, revoked := ac.checkRevoked(&entry); revoked {
+				ac.revoke(&entry, reason)
+			}
+		}
+	}
+}
+
+const (
+	// revokedGone means the controller no longer knows the allocation.
+	revokedGone = "allocation no longer exists"
+	// revokedReassigned means the controller serves the allocation
+	// differently, it still holds it until released.
+	revokedReassigned = "allocation was reassigned"
+)
+
+// checkRevoked compares the allocation detail of the controller with the one
+// recorded when the allocation was confirmed, on the fields the plugin relies
+// on.
+func (ac *AsakaControllerClient) checkRevoked(entry *allocationEntry) (string, bool) {
+	detail, err := ac.queryVGPUAllocations(entry.AllocationId)
+	if err != nil {
+		if isNotFound(err) {
+			return revokedGone, true
+		}
+		log.Debugf("Query allocation %s error: %s", entry.AllocationId, err)
+		return "", false
+	}
+
+	baseline := entry.Detail
+	if baseline == "" {
+		baseline = entry.AllocationStr
+	}
+	same, err := sameAllocation(entry.AllocationId, baseline, detail)
+	if err != nil {
+		log.Debugf("Compare allocation %s error: %s", entry.AllocationId, err)
+		return "", false
+	}
+	if !same {
+		return revokedReassigned, true
+	}
+	return "", false
+}
+
+func (ac *AsakaControllerClient) revoke(entry *allocationEntry, reason string) {
+	unlock := ac.ledger.Lock(entry.VgpuIds)
+	defer unlock()
+
+	current, ok := ac.ledger.Get(entry.VgpuIds)
+	if !ok || current.AllocationId != entry.AllocationId || current.State != allocationConfirmed {
+		return
+	}
+
+	now := time.Now()
+	ac.ledger.Update(entry.VgpuIds, func(e *allocationEntry) {
+		e.State = allocationRevoked
+		e.RevokedAt = now
+		e.RevokedReason = reason
+	})
+	log.Warnf("Allocation %s of vGPUs %v was revoked by the XaaS Controller: %s",
+		entry.AllocationId, entry.VgpuIds, reason)
+
+	if currentConfig().RevocationMarkers {
+		marker := revocationMarker{
+			AllocationId: entry.AllocationId,
+			VgpuIds:      entry.VgpuIds,
+			Reason:       reason,
+			RevokedAt:    now,
+		}
+		if err := writeRevocationMarker(entry, marker); err != nil {
+			log.Errorf("Write revocation marker of allocation %s error: %s", entry.AllocationId, err)
+		}
+	}
+}
+
+func writeRevocationMarker(entry *allocationEntry, marker revocationMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	dir, err := configDir(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, "revoked"), data)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
 	"path"
@@ -15,29 +16,52 @@ import (
 )
 
 const (
-	resourceName    = "asaka/vgpu"
-	serverSock      = pluginapi.DevicePluginPath + "asaka-vgpu.sock"
+	kubeletSocketName = "kubelet.sock"
+
 	cudaRequestType = "cudaGPU"
+	servedProtocol  = "CUDA"
+
+	stateDir      = "/var/lib/asaka-vgpu/"
+	vgpuIdMapFile = stateDir + "vgpu-ids.json"
+	ledgerFile    = stateDir + "ledger.json"
 )
 
 // AsakaVgpuDevicePlugin implements the Kubernetes device plugin API
 type AsakaVgpuDevicePlugin struct {
-	socket string
-	stop   chan interface{}
-	server *grpc.Server
+	resourceName  string
+	kubeletSocket string
+	socket        string
+	poller        *inventoryPoller
+	stop          chan interface{}
+	server        *grpc.Server
 }
 
 // NewAsakaVgpuDevicePlugin returns an initialized AsakaVgpuDevicePlugin
 func NewAsakaVgpuDevicePlugin() *AsakaVgpuDevicePlugin {
+	config := currentConfig()
 	return &AsakaVgpuDevicePlugin{
-		socket: serverSock,
+		resourceName:  config.ResourceName,
+		kubeletSocket: path.Join(config.KubeletDir, kubeletSocketName),
+		socket:        path.Join(config.KubeletDir, config.SocketName),
+		poller:        newInventoryPoller(config.ResourceName, asakaControllerClient.GetDevices),
 
 		stop: make(chan interface{}),
 	}
 }
 
 func (m *AsakaVgpuDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{}, nil
+	return m.options(), nil
+}
+
+func (m *AsakaVgpuDevicePlugin) options() *pluginapi.DevicePluginOptions {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired: preStartRequired(currentConfig()),
+	}
+}
+
+// preStartRequired reports whether config needs PreStartContainer calls.
+func preStartRequired(config *PluginConfig) bool {
+	return config.TwoPhaseAllocation || config.PreStartValidation
 }
 
 // dial establishes the gRPC communication with the registered device plugin.
@@ -76,26 +100,66 @@ func (m *AsakaVgpuDevicePlugin) Start() error {
 	// Wait for server to start by launching a blocking connexion
 	conn, err := dial(m.socket, 5*time.Second)
 	if err != nil {
+		m.server.Stop()
+		m.server = nil
+		m.cleanup()
 		return err
 	}
 	conn.Close()
 
+	// Only started once the server is up, Stop stops them.
+	m.poller.Start()
+	go asakaControllerClient.ReapReservations(m.stop)
+	go asakaControllerClient.WatchRevocations(m.stop)
+
 	return nil
 }
 
-// Stop stops the gRPC server
+// Stop stops the gRPC server once the in-flight calls are done
 func (m *AsakaVgpuDevicePlugin) Stop() error {
 	if m.server == nil {
 		return nil
 	}
 
-	m.server.Stop()
-	m.server = nil
+	log.Info("Stopping device plugin.")
+	// Ends the ListAndWatch streams, so that only the allocation calls are
+	// left to drain.
 	close(m.stop)
+	drain(m.server, currentConfig().DrainTimeout)
+	m.server = nil
+	m.poller.Stop()
+	asakaControllerClient.ledger.Flush()
 
 	return m.cleanup()
 }
 
+// drain stops server from accepting RPCs and waits for the in-flight ones
+// until timeout, then aborts them.
+func drain(server *grpc.Server, timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Warnf("In-flight calls didn't finish within %s, aborting them.", timeout)
+		server.Stop()
+	}
+}
+
+// stopping reports whether the plugin is being stopped.
+func (m *AsakaVgpuDevicePlugin) stopping() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 // Register registers the device plugin for the given resourceName with Kubelet.
 func (m *AsakaVgpuDevicePlugin) Register(kubeletEndpoint, resourceName string) error {
 	conn, err := dial(kubeletEndpoint, 5*time.Second)
@@ -109,6 +173,7 @@ func (m *AsakaVgpuDevicePlugin) Register(kubeletEndpoint, resourceName string) e
 		Version:      pluginapi.Version,
 		Endpoint:     path.Base(m.socket),
 		ResourceName: resourceName,
+		Options:      m.options(),
 	}
 
 	_, err = client.Register(context.Background(), reqt)
@@ -118,18 +183,26 @@ func (m *AsakaVgpuDevicePlugin) Register(kubeletEndpoint, resourceName string) e
 	return nil
 }
 
-// ListAndWatch lists devices and update that list per second
+// ListAndWatch sends the inventory of the shared poller until the stream
+// breaks, kubelet cancels it or the plugin stops.
 func (m *AsakaVgpuDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	devs := asakaControllerClient.GetDevices()
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: devs})
+	snapshots, unsubscribe := m.poller.Subscribe()
+	defer unsubscribe()
+	listAndWatchStreams.Add(1, m.resourceName)
+	defer listAndWatchStreams.Add(-1, m.resourceName)
 
 	for {
 		select {
 		case <-m.stop:
 			return nil
-		case <-time.After(time.Second):
-			devs = asakaControllerClient.GetDevices()
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: devs})
+		case <-s.Context().Done():
+			log.Info("ListAndWatch stream closed by kubelet.")
+			return nil
+		case devs := <-snapshots:
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				log.Errorf("ListAndWatch send error: %s", err)
+				return err
+			}
 		}
 	}
 }
@@ -137,35 +210,73 @@ func (m *AsakaVgpuDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.Dev
 // Allocate which return list of devices.
 func (m *AsakaVgpuDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	responses := pluginapi.AllocateResponse{}
-	for _, req := range reqs.ContainerRequests {
-		envMap, err := asakaControllerClient.AllocateVGPU(req.DevicesIDs)
+	for i, req := range reqs.ContainerRequests {
+		start := time.Now()
+		response, err := asakaControllerClient.AllocateVGPU(req.DevicesIDs)
+		operationDuration.Observe(time.Since(start), m.resourceName, "allocate", result(err))
 		if err != nil {
+			// Kubelet fails the whole request, the containers allocated so
+			// far won't start either.
+			rollback(reqs.ContainerRequests[:i])
 			return nil, err
 		}
-		stringEnv, _ := json.Marshal(envMap)
-		log.Info("Set the env for the container: ", string(stringEnv))
-
-		response := pluginapi.ContainerAllocateResponse{
-			Envs: envMap,
+		// The response can't reach kubelet once the call was aborted by
+		// Stop, don't leave allocations no container will use.
+		if ctx.Err() != nil && m.stopping() {
+			rollback(reqs.ContainerRequests[:i+1])
+			return nil, fmt.Errorf("Device plugin stopped during allocation")
 		}
+		stringEnv, _ := json.Marshal(response.Envs)
+		log.Info("Set the env for the container: ", string(stringEnv))
 
-		responses.ContainerResponses = append(responses.ContainerResponses, &response)
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
 	}
 
 	return &responses, nil
 }
 
+// rollback releases the allocations made for reqs.
+func rollback(reqs []*pluginapi.ContainerAllocateRequest) {
+	for _, req := range reqs {
+		log.Warnf("Roll back the allocation of vGPUs %v.", req.DevicesIDs)
+		if err := asakaControllerClient.ReleaseVGPU(req.DevicesIDs); err != nil {
+			log.Errorf("Roll back the allocation of vGPUs %v error: %s", req.DevicesIDs, err)
+		}
+	}
+}
+
 func (m *AsakaVgpuDevicePlugin) Release(ctx context.Context, reqs *pluginapi.ReleaseRequest) (*pluginapi.ReleaseResponse, error) {
 	responses := pluginapi.ReleaseResponse{}
 	for _, req := range reqs.ContainerRequests {
-		if err := asakaControllerClient.ReleaseVGPU(req.DevicesIDs); err != nil {
+		start := time.Now()
+		err := asakaControllerClient.ReleaseVGPU(req.DevicesIDs)
+		operationDuration.Observe(time.Since(start), m.resourceName, "release", result(err))
+		if err != nil {
 			return nil, err
 		}
 	}
 	return &responses, nil
 }
 
-func (m *AsakaVgpuDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+// PreStartContainer confirms the allocation reserved in Allocate and checks
+// that the allocations of the container are still live right before it starts.
+func (m *AsakaVgpuDevicePlugin) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	config := currentConfig()
+	if config.TwoPhaseAllocation {
+		start := time.Now()
+		err := asakaControllerClient.ConfirmVGPU(req.DevicesIDs)
+		operationDuration.Observe(time.Since(start), m.resourceName, "confirm", result(err))
+		if err != nil {
+			log.Errorf("Confirm vGPUs %v error: %s", req.DevicesIDs, err)
+			return nil, err
+		}
+	}
+	if config.PreStartValidation {
+		if err := asakaControllerClient.ValidateVGPU(req.DevicesIDs); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
 
@@ -186,7 +297,7 @@ func (m *AsakaVgpuDevicePlugin) Serve() error {
 	}
 	log.Info("Starting to serve on ", m.socket)
 
-	err = m.Register(pluginapi.KubeletSocket, resourceName)
+	err = m.Register(m.kubeletSocket, m.resourceName)
 	if err != nil {
 		log.Infof("Could not register device plugin: %s", err)
 		m.Stop()
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// startStatusServer serves the liveness and readiness of the plugin on
+// address.
+func startStatusServer(address string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	return startHttpServer("status", address, mux)
+}
+
+// startMetricsServer serves the Prometheus metrics of the plugin on address.
+func startMetricsServer(address string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	return startHttpServer("metrics", address, mux)
+}
+
+func startHttpServer(name, address string, handler http.Handler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Listen on %s address %s error: %s", name, address, err)
+	}
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Serve %s error: %s", name, err)
+		}
+	}()
+	log.Infof("Serving %s on %s.", name, address)
+	return server, nil
+}
+
+// ready returns why the plugin isn't ready, nil when it is.
+func ready() error {
+	if pluginSupervisor != nil {
+		if state := pluginSupervisor.State(); state != stateServing {
+			return fmt.Errorf("Device plugin is %s", state)
+		}
+	}
+	if err := asakaControllerClient.ConnectionError(); err != nil {
+		return fmt.Errorf("XaaS Controller is unreachable: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+type supervisorState string
+
+const (
+	stateStarting    supervisorState = "starting"
+	stateRegistering supervisorState = "registering"
+	stateServing     supervisorState = "serving"
+	stateBackoff     supervisorState = "backoff"
+	stateStopping    supervisorState = "stopping"
+	stateHandedOver  supervisorState = "handed over"
+)
+
+const (
+	registerInitialBackoff = time.Second
+	registerMaxBackoff     = time.Minute
+)
+
+// supervisor runs the device plugin and keeps it registered with kubelet,
+// retrying with backoff until registration succeeds.
+type supervisor struct {
+	kubeletSocket string
+	configDir     string
+
+	mu    sync.Mutex
+	state supervisorState
+
+	plugin   *AsakaVgpuDevicePlugin
+	backoff  time.Duration
+	retry    <-chan time.Time
+	watchdog <-chan time.Time
+	started  bool
+}
+
+var pluginSupervisor *supervisor
+
+func newSupervisor(kubeletSocket, configDir string) *supervisor {
+	return &supervisor{
+		kubeletSocket: kubeletSocket,
+		configDir:     configDir,
+		state:         stateStarting,
+		backoff:       registerInitialBackoff,
+	}
+}
+
+// State returns the current state of the supervisor.
+func (s *supervisor) State() supervisorState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+func (s *supervisor) setState(state supervisorState, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Infof("Device plugin %s -> %s: %s", s.state, state, reason)
+	s.state = state
+}
+
+// Run keeps the device plugin registered until a termination signal or until
+// a new instance takes over.
+func (s *supervisor) Run(watcher *fsnotify.Watcher, sigs <-chan os.Signal, handover *handoverServer) {
+	s.start("initial registration")
+	s.scheduleWatchdog()
+
+	for {
+		select {
+		case <-s.retry:
+			s.start("retrying registration")
+
+		case <-s.watchdog:
+			s.checkPlugin()
+
+		case event := <-watcher.Events:
+			s.handleEvent(event)
+
+		case err := <-watcher.Errors:
+			log.Infof("inotify: %s", err)
+
+		case conn := <-handover.requests:
+			s.setState(stateStopping, "handing over to a new instance")
+			s.stopPlugin()
+			if !handover.handOver(conn) {
+				s.resetBackoff()
+				s.start("handover failed")
+				continue
+			}
+			s.idle(watcher, sigs, handover)
+			return
+
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				log.Info("Received SIGHUP, restarting.")
+				reloadConfig()
+				s.resetBackoff()
+				s.start("SIGHUP")
+				continue
+			}
+			s.setState(stateStopping, "received signal "+sig.String())
+			s.stopPlugin()
+			return
+		}
+	}
+}
+
+// idle waits for a termination signal once the state was handed over, without
+// serving nor registering. Exiting would have the DaemonSet restart the old
+// instance, which would take over again.
+func (s *supervisor) idle(watcher *fsnotify.Watcher, sigs <-chan os.Signal, handover *handoverServer) {
+	s.setState(stateHandedOver, "waiting for termination")
+	watcher.Close()
+	handover.Close()
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Infof("Received signal %s, exiting.", sig)
+			return
+		}
+	}
+}
+
+func (s *supervisor) handleEvent(event fsnotify.Event) {
+	switch {
+	case event.Name == s.kubeletSocket && event.Op&fsnotify.Create == fsnotify.Create:
+		s.resetBackoff()
+		s.start("kubelet socket created")
+
+	case event.Name == s.kubeletSocket && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		s.stopPlugin()
+		s.waitForRetry("kubelet socket removed")
+
+	case s.plugin != nil && event.Name == s.plugin.socket && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		// The socket is also removed when the plugin itself restarts,
+		// only a socket that is gone for good needs a restart.
+		if _, err := os.Stat(event.Name); os.IsNotExist(err) && s.State() == stateServing {
+			s.start("plugin socket removed")
+		}
+
+	case s.configDir != "" && isInDir(event.Name, s.configDir):
+		if reloadConfig() {
+			s.resetBackoff()
+			s.start("config changed")
+		}
+	}
+}
+
+// start (re)starts the device plugin and registers it with kubelet.
+func (s *supervisor) start(reason string) {
+	s.stopPlugin()
+	s.setState(stateRegistering, reason)
+
+	s.plugin = NewAsakaVgpuDevicePlugin()
+	if s.started {
+		pluginRestarts.Add(1, s.plugin.resourceName)
+	}
+	s.started = true
+
+	err := s.plugin.Serve()
+	registrations.Add(1, s.plugin.resourceName, result(err))
+	if err != nil {
+		s.plugin = nil
+		s.waitForRetry("registration failed: " + err.Error())
+		return
+	}
+	s.resetBackoff()
+	s.retry = nil
+	s.setState(stateServing, "registered with kubelet")
+}
+
+// waitForRetry schedules the next registration attempt with exponential
+// backoff.
+func (s *supervisor) waitForRetry(reason string) {
+	s.setState(stateBackoff, reason+", retrying in "+s.backoff.String())
+	s.retry = time.After(s.backoff)
+	if s.backoff *= 2; s.backoff > registerMaxBackoff {
+		s.backoff = registerMaxBackoff
+	}
+}
+
+func (s *supervisor) resetBackoff() {
+	s.backoff = registerInitialBackoff
+}
+
+func (s *supervisor) stopPlugin() {
+	if s.plugin != nil {
+		s.plugin.Stop()
+		s.plugin = nil
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxVgpuIdLength is the longest device ID kubelet accepts from a device plugin.
+const maxVgpuIdLength = 63
+
+// vgpuSlot identifies one vGPU slot of a physical device on the XaaS Controller.
+type vgpuSlot struct {
+	DeviceId string `json:"device_id"`
+	Index    int    `json:"index"`
+}
+
+// vgpuIdMap maps the device IDs advertised to kubelet back to the controller
+// device ID and slot. It is persisted so that IDs kubelet has checkpointed
+// can still be resolved after the plugin restarts.
+type vgpuIdMap struct {
+	mu    sync.Mutex
+	path  string
+	slots map[string]vgpuSlot
+	// readOnly keeps new IDs in memory, for the processes inspecting the
+	// map of the serving plugin.
+	readOnly bool
+}
+
+func newVgpuIdMap(path string) *vgpuIdMap {
+	m := &vgpuIdMap{
+		path:  path,
+		slots: make(map[string]vgpuSlot),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Read vGPU ID map %s error: %s", path, err)
+		}
+		return m
+	}
+	if err = json.Unmarshal(data, &m.slots); err != nil {
+		log.Errorf("Parse vGPU ID map %s error: %s", path, err)
+		m.slots = make(map[string]vgpuSlot)
+	}
+	return m
+}
+
+// vgpuIdFor returns the device ID advertised for a slot. The legacy
+// "<deviceId>:<index>" form is kept when it fits, otherwise the controller
+// device ID is replaced by a hash of it.
+func vgpuIdFor(slot vgpuSlot) string {
+	vgpuID := slot.DeviceId + ":" + strconv.Itoa(slot.Index)
+	if len(vgpuID) <= maxVgpuIdLength {
+		return vgpuID
+	}
+
+	hasher := fnv.New64a()
+	hasher.Write([]byte(slot.DeviceId))
+	return fmt.Sprintf("vgpu-%016x:%d", hasher.Sum64(), slot.Index)
+}
+
+// IdFor returns the device ID for a slot and records it in the reverse map.
+func (m *vgpuIdMap) IdFor(deviceId string, index int) string {
+	slot := vgpuSlot{DeviceId: deviceId, Index: index}
+	vgpuID := vgpuIdFor(slot)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if known, ok := m.slots[vgpuID]; ok {
+		if known != slot {
+			log.Errorf("vGPU ID %s of device %s slot %d collides with device %s slot %d.",
+				vgpuID, deviceId, index, known.DeviceId, known.Index)
+		}
+		return vgpuID
+	}
+
+	m.slots[vgpuID] = slot
+	if m.readOnly {
+		return vgpuID
+	}
+	if err := m.save(); err != nil {
+		log.Errorf("Save vGPU ID map %s error: %s", m.path, err)
+	}
+	return vgpuID
+}
+
+// SetReadOnly stops persisting the map.
+func (m *vgpuIdMap) SetReadOnly() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.readOnly = true
+}
+
+// Lookup resolves a device ID advertised to kubelet back to its slot.
+func (m *vgpuIdMap) Lookup(vgpuID string) (vgpuSlot, bool) {
+	m.mu.Lock()
+	slot, ok := m.slots[vgpuID]
+	m.mu.Unlock()
+	if ok {
+		return slot, true
+	}
+
+	// IDs advertised before the map existed use the legacy form.
+	sep := strings.LastIndex(vgpuID, ":")
+	if sep <= 0 {
+		return vgpuSlot{}, false
+	}
+	index, err := strconv.Atoi(vgpuID[sep+1:])
+	if err != nil {
+		return vgpuSlot{}, false
+	}
+	return vgpuSlot{DeviceId: vgpuID[:sep], Index: index}, true
+}
+
+// Slots resolves a list of device IDs, skipping the ones that are unknown.
+func (m *vgpuIdMap) Slots(vgpuIds []string) []vgpuSlot {
+	var slots []vgpuSlot
+	for _, vgpuID := range vgpuIds {
+		slot, ok := m.Lookup(vgpuID)
+		if !ok {
+			log.Warnf("Unknown vGPU ID: %s", vgpuID)
+			continue
+		}
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+func (m *vgpuIdMap) save() error {
+	data, err := json.Marshal(m.slots)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, data)
+}
+
+// writeFileAtomic replaces the file at path so that readers never observe a
+// partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
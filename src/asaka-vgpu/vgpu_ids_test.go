@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVgpuIdFor(t *testing.T) {
+	longDeviceId := "GPU-" + strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		name string
+		slot vgpuSlot
+		want string
+	}{
+		{
+			name: "legacy form",
+			slot: vgpuSlot{DeviceId: "GPU-0", Index: 3},
+			want: "GPU-0:3",
+		},
+		{
+			name: "legacy form at the length limit",
+			slot: vgpuSlot{DeviceId: strings.Repeat("d", maxVgpuIdLength-2), Index: 7},
+			want: strings.Repeat("d", maxVgpuIdLength-2) + ":7",
+		},
+		{
+			name: "hashed over the length limit",
+			slot: vgpuSlot{DeviceId: strings.Repeat("d", maxVgpuIdLength-1), Index: 7},
+			want: "vgpu-6b35c36f0af9ac35:7",
+		},
+		{
+			name: "hashed long device ID",
+			slot: vgpuSlot{DeviceId: longDeviceId, Index: 0},
+			want: "vgpu-c0646605316a0f68:0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := vgpuIdFor(test.slot)
+			if got != test.want {
+				t.Errorf("vgpuIdFor(%v) = %q, want %q", test.slot, got, test.want)
+			}
+			if len(got) > maxVgpuIdLength {
+				t.Errorf("vgpuIdFor(%v) = %q is longer than %d", test.slot, got, maxVgpuIdLength)
+			}
+		})
+	}
+}
+
+func TestVgpuIdForIsStable(t *testing.T) {
+	longDeviceId := "GPU-" + strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		name      string
+		a, b      vgpuSlot
+		wantEqual bool
+	}{
+		{
+			name:      "same slot",
+			a:         vgpuSlot{DeviceId: longDeviceId, Index: 1},
+			b:         vgpuSlot{DeviceId: longDeviceId, Index: 1},
+			wantEqual: true,
+		},
+		{
+			name: "other index",
+			a:    vgpuSlot{DeviceId: longDeviceId, Index: 1},
+			b:    vgpuSlot{DeviceId: longDeviceId, Index: 2},
+		},
+		{
+			name: "other device",
+			a:    vgpuSlot{DeviceId: longDeviceId, Index: 1},
+			b:    vgpuSlot{DeviceId: longDeviceId + "0", Index: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := vgpuIdFor(test.a), vgpuIdFor(test.b)
+			if (a == b) != test.wantEqual {
+				t.Errorf("vgpuIdFor(%v) = %q and vgpuIdFor(%v) = %q, want equal: %v",
+					test.a, a, test.b, b, test.wantEqual)
+			}
+		})
+	}
+}
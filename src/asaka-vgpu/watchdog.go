@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+const watchdogTimeout = 5 * time.Second
+
+// checkHealth verifies that the plugin socket is still in the kubelet
+// directory and that the gRPC server answers on it.
+func (m *AsakaVgpuDevicePlugin) checkHealth(timeout time.Duration) error {
+	if _, err := os.Stat(m.socket); err != nil {
+		return fmt.Errorf("Plugin socket error: %s", err)
+	}
+
+	conn, err := dial(m.socket, timeout)
+	if err != nil {
+		return fmt.Errorf("Dial plugin socket %s error: %s", m.socket, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client := pluginapi.NewDevicePluginClient(conn)
+	if _, err := client.GetDevicePluginOptions(ctx, &pluginapi.Empty{}); err != nil {
+		return fmt.Errorf("GetDevicePluginOptions error: %s", err)
+	}
+	return nil
+}
+
+// scheduleWatchdog schedules the next check of the served plugin.
+func (s *supervisor) scheduleWatchdog() {
+	interval := currentConfig().WatchdogInterval
+	if interval <= 0 {
+		// The watchdog may be enabled by a config reload.
+		interval = currentConfig().PollInterval
+	}
+	s.watchdog = time.After(interval)
+}
+
+// checkPlugin restarts the plugin when it no longer answers on its socket.
+func (s *supervisor) checkPlugin() {
+	defer s.scheduleWatchdog()
+
+	if currentConfig().WatchdogInterval <= 0 || s.plugin == nil || s.State() != stateServing {
+		return
+	}
+	if err := s.plugin.checkHealth(watchdogTimeout); err != nil {
+		log.Warnf("Device plugin watchdog check failed: %s", err)
+		s.start("watchdog check failed")
+	}
+}